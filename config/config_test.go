@@ -0,0 +1,99 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "visit.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileFetchDelay(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		delay   uint
+	}{
+		{"beacon_addr: localhost:5052\n", 4},
+		{"fetch_delay_seconds: 6\n", 6},
+		{"fetch_block_seconds: 2\n", 2},
+	} {
+		cfg := defaultConfig()
+		if err := loadConfigFile(cfg, writeConfigFile(t, test.content)); err != nil {
+			t.Fatalf("%q: %v", test.content, err)
+		}
+		if cfg.FetchDelaySeconds != test.delay {
+			t.Errorf("%q: fetch delay %d, expected %d", test.content, cfg.FetchDelaySeconds, test.delay)
+		}
+	}
+}
+
+func TestConfigFileRejectsBothDelayKeys(t *testing.T) {
+	content := "fetch_delay_seconds: 6\nfetch_block_seconds: 2\n"
+	if err := loadConfigFile(defaultConfig(), writeConfigFile(t, content)); err == nil {
+		t.Errorf("%q: expected an error", content)
+	}
+}
+
+func TestConfigFileEmpty(t *testing.T) {
+	cfg := defaultConfig()
+	if err := loadConfigFile(cfg, writeConfigFile(t, "")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("empty config file changed the defaults: %+v", cfg)
+	}
+}
+
+func TestConfigFileRejectsUnknownKeys(t *testing.T) {
+	content := "fetch_delay_secs: 6\n"
+	if err := loadConfigFile(defaultConfig(), writeConfigFile(t, content)); err == nil {
+		t.Errorf("%q: expected an error", content)
+	}
+}
+
+func TestLoadConfigRanges(t *testing.T) {
+	for _, args := range [][]string{
+		{"-database-batch-size", "0"},
+		{"-database-batch-size", "-5"},
+		{"-same-block-retries", "0"},
+		{"-same-block-retries", "1000"},
+		{"-fetch-delay-seconds", "60"},
+		{"-slashing-history-epochs", "0"},
+		{"-slashing-history-epochs", "100000"},
+	} {
+		if _, err := LoadConfig(append(args, "localhost:5052")); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+
+	cfg, err := LoadConfig([]string{"-database-batch-size", "1", "-same-block-retries", "1", "localhost:5052"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DatabaseBatchSize != 1 || cfg.SameBlockRetries != 1 {
+		t.Errorf("wrong config: %+v", cfg)
+	}
+}
+
+func TestFindConfigPath(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		path string
+	}{
+		{[]string{"-config", "a.yaml"}, "a.yaml"},
+		{[]string{"--config=a.yaml", "localhost:5052"}, "a.yaml"},
+		{[]string{"-config", "a.yaml", "--", "-config", "b.yaml"}, "a.yaml"},
+		{[]string{"--", "-config=b.yaml"}, ""},
+	} {
+		if path := findConfigPath(test.args); path != test.path {
+			t.Errorf("%v: got %q, expected %q", test.args, path, test.path)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Knobs of `visit export`. Database settings come from the usual places (see
+// LoadConfig()), the rest only from flags and the environment.
+type ExportConfig struct {
+	*Config
+
+	// Output format (one of the Format* constants) and file ("-" is stdout)
+	Format string
+	Output string
+
+	// Which table to read: ExportState or ExportDuties
+	Source string
+
+	// Epoch range to export. Both ends are inclusive; negative values mean
+	// no bound.
+	FromEpoch int
+	ToEpoch   int
+
+	// Only export these validators (all of them if empty)
+	Validators []int
+
+	// Only export rows with this status ("perfect", "slow", "missing" or
+	// "inactive"; all of them if empty)
+	Status string
+}
+
+// Export formats
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// Export sources
+const (
+	ExportState  = "state"
+	ExportDuties = "duties"
+)
+
+// Build the configuration of `visit export` out of the defaults, the config
+// file, the environment and the command line `args` (without "visit export").
+func LoadExportConfig(args []string) (*ExportConfig, error) {
+	cfg, configPath, err := loadDefaultsAndFile(args)
+	if err != nil {
+		return nil, err
+	}
+	ecfg := &ExportConfig{
+		Config:    cfg,
+		Format:    FormatCSV,
+		Output:    "-",
+		Source:    ExportState,
+		FromEpoch: -1,
+		ToEpoch:   -1,
+	}
+
+	fs := flag.NewFlagSet("visit export", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n\t./visit export [flags]\n\n"+
+			"Every flag can also be set with a %s<FLAG_NAME> environment variable.\n\nFlags:\n", envPrefix)
+		fs.PrintDefaults()
+	}
+	fs.String(configFlag, configPath, "path to a YAML config file")
+	addDatabaseFlags(fs, cfg)
+	fs.StringVar(&ecfg.Format, "format", ecfg.Format,
+		"output format: \""+FormatCSV+"\", \""+FormatJSONL+"\" or \""+FormatParquet+"\"")
+	fs.StringVar(&ecfg.Output, "output", ecfg.Output, "file to write to (\"-\" for stdout)")
+	fs.StringVar(&ecfg.Source, "source", ecfg.Source,
+		"what to export: \""+ExportState+"\" (validator_state) or \""+ExportDuties+"\" (every duty, needs -store-all-duties)")
+	fs.IntVar(&ecfg.FromEpoch, "from-epoch", ecfg.FromEpoch, "first epoch to export")
+	fs.IntVar(&ecfg.ToEpoch, "to-epoch", ecfg.ToEpoch, "last epoch to export (inclusive)")
+	fs.Var(intList{&ecfg.Validators}, "validators", "comma separated validator indices to export")
+	fs.StringVar(&ecfg.Status, "status", ecfg.Status, "only export \"perfect\", \"slow\", \"missing\" or \"inactive\" rows")
+
+	if err := parseFlags(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("too many arguments: %v", fs.Args())
+	}
+
+	if err := checkDatabaseConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	if ecfg.Format != FormatCSV && ecfg.Format != FormatJSONL && ecfg.Format != FormatParquet {
+		return nil, fmt.Errorf("unknown export format %q", ecfg.Format)
+	}
+
+	if ecfg.Source != ExportState && ecfg.Source != ExportDuties {
+		return nil, fmt.Errorf("unknown export source %q", ecfg.Source)
+	}
+
+	if ecfg.Status != "" && ecfg.Status != "perfect" && ecfg.Status != "slow" && ecfg.Status != "missing" &&
+		ecfg.Status != "inactive" {
+		return nil, fmt.Errorf("unknown status %q", ecfg.Status)
+	}
+
+	if ecfg.FromEpoch >= 0 && ecfg.ToEpoch >= 0 && ecfg.ToEpoch < ecfg.FromEpoch {
+		return nil, fmt.Errorf("invalid epoch range: epochs #%d to #%d", ecfg.FromEpoch, ecfg.ToEpoch)
+	}
+
+	return ecfg, nil
+}
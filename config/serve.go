@@ -0,0 +1,51 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Knobs of `visit serve`. Database settings come from the usual places (see
+// LoadConfig()).
+type ServeConfig struct {
+	*Config
+
+	// Address (ip:port) to serve the visualization and the API on
+	ListenAddr string
+}
+
+// Build the configuration of `visit serve` out of the defaults, the config
+// file, the environment and the command line `args` (without "visit serve").
+func LoadServeConfig(args []string) (*ServeConfig, error) {
+	cfg, configPath, err := loadDefaultsAndFile(args)
+	if err != nil {
+		return nil, err
+	}
+	scfg := &ServeConfig{
+		Config:     cfg,
+		ListenAddr: "127.0.0.1:8080",
+	}
+
+	fs := flag.NewFlagSet("visit serve", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n\t./visit serve [flags]\n\n"+
+			"Every flag can also be set with a %s<FLAG_NAME> environment variable.\n\nFlags:\n", envPrefix)
+		fs.PrintDefaults()
+	}
+	fs.String(configFlag, configPath, "path to a YAML config file")
+	addDatabaseFlags(fs, cfg)
+	fs.StringVar(&scfg.ListenAddr, "listen-addr", scfg.ListenAddr, "address (ip:port) to serve on")
+
+	if err := parseFlags(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("too many arguments: %v", fs.Args())
+	}
+
+	if err := checkDatabaseConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return scfg, nil
+}
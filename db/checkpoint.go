@@ -0,0 +1,289 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/asn-d6/visit/metrics"
+)
+
+// Row of the activity tracker for an epoch that has not been flushed yet
+type ActivityRow struct {
+	ValidatorIdx int
+	Epoch        int
+	Distance     int
+
+	// Inclusion distance not counting the empty slots in between (that's
+	// the distance the validator is to blame for)
+	EffectiveDistance int
+
+	// Participation flags (see FlagTimelySource and friends)
+	Flags int
+
+	// Status of missing validators according to the beacon node (e.g.
+	// "active_exiting" or "active_slashed"), if we know it. Only filled in
+	// when the epoch gets written.
+	ValidatorStatus string
+}
+
+// A committee we are tracking
+type CommitteeRow struct {
+	Slot       int
+	Index      int
+	Validators []int
+}
+
+// Everything we need to pick up collecting where we left off
+type Checkpoint struct {
+	// The last slot we fully processed
+	LastSlot int
+
+	// The first slot we saw since we started collecting
+	FirstSlotSeen int
+
+	// Activity of the epochs that are still within their inclusion window
+	PendingActivity []ActivityRow
+
+	// Validators that have been flagged as interesting so far
+	InterestingValidators []int
+
+	// Slots without a block that we still need for effective distances
+	EmptySlots []int
+
+	// Proposals of the epochs that have not been flushed yet
+	PendingProposals []ProposalRow
+
+	// Sync committee participation of the epochs that have not been flushed yet
+	PendingSync []SyncRow
+
+	// Lifecycle events of the epochs that have not been flushed yet
+	PendingEvents []LifecycleRow
+
+	// The committees we are tracking
+	Committees []CommitteeRow
+}
+
+// Replace the stored checkpoint of our collector with `cp`. The checkpoint is
+// stored as a single blob (see encodeCheckpoint()), so that it costs one row
+// write however many validators we are tracking.
+func (db *Database) SaveCheckpoint(cp *Checkpoint) error {
+	defer metrics.TimeDBWrite("save_checkpoint").ObserveDuration()
+
+	state, err := encodeCheckpoint(cp)
+	if err != nil {
+		return &StorageError{Op: "save checkpoint", Err: err}
+	}
+
+	err = db.inTransaction(func(tx *sql.Tx) error {
+		return db.saveCheckpoint(tx, cp.LastSlot, state)
+	})
+	if err != nil {
+		return &StorageError{Op: "save checkpoint", Err: err}
+	}
+	return nil
+}
+
+// Where checkpoints used to be spread over, one row per item
+var legacyCheckpointTables = []string{"checkpoint_cursor", "checkpoint_activity", "checkpoint_interesting",
+	"checkpoint_committee", "checkpoint_empty_slot", "checkpoint_proposal", "checkpoint_sync", "checkpoint_event"}
+
+const saveCheckpointQuery = `INSERT INTO checkpoint_state(collector, last_slot, state) VALUES(?, ?, ?)
+	ON CONFLICT (collector) DO UPDATE SET last_slot = excluded.last_slot, state = excluded.state`
+
+func (db *Database) saveCheckpoint(tx *sql.Tx, lastSlot int, state []byte) error {
+	if _, err := tx.Exec(db.q(saveCheckpointQuery), db.collector, lastSlot, state); err != nil {
+		return err
+	}
+
+	// The old checkpoint of our collector (if any) is obsolete now
+	for _, table := range legacyCheckpointTables {
+		if _, err := tx.Exec(db.q("DELETE FROM "+table+" WHERE collector = ?"), db.collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serialize `cp`: gob, gzipped
+func encodeCheckpoint(cp *Checkpoint) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(cp); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCheckpoint(state []byte) (*Checkpoint, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(state))
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := gob.NewDecoder(zr).Decode(&cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Load the stored checkpoint of our collector. Returns nil if there is none.
+func (db *Database) LoadCheckpoint() (*Checkpoint, error) {
+	var state []byte
+	err := db.db.QueryRow(db.q("SELECT state FROM checkpoint_state WHERE collector = ?"), db.collector).Scan(&state)
+	if err == sql.ErrNoRows {
+		return db.loadLegacyCheckpoint()
+	} else if err != nil {
+		return nil, &StorageError{Op: "load checkpoint", Err: err}
+	}
+
+	cp, err := decodeCheckpoint(state)
+	if err != nil {
+		return nil, &StorageError{Op: "load checkpoint", Err: err}
+	}
+	return cp, nil
+}
+
+// Load the checkpoint of our collector from the tables an older visit saved
+// it to. Returns nil if there is none.
+func (db *Database) loadLegacyCheckpoint() (*Checkpoint, error) {
+	var cp Checkpoint
+	err := db.db.QueryRow(db.q("SELECT last_slot, first_slot_seen FROM checkpoint_cursor WHERE collector = ?"), db.collector).Scan(&cp.LastSlot, &cp.FirstSlotSeen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, &StorageError{Op: "load checkpoint", Err: err}
+	}
+
+	if err := db.loadCheckpointRows(&cp); err != nil {
+		return nil, &StorageError{Op: "load checkpoint", Err: err}
+	}
+	return &cp, nil
+}
+
+func (db *Database) loadCheckpointRows(cp *Checkpoint) error {
+	rows, err := db.db.Query(db.q("SELECT validator_idx, epoch, distance, effective_distance, flags FROM checkpoint_activity WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var row ActivityRow
+		if err := rows.Scan(&row.ValidatorIdx, &row.Epoch, &row.Distance, &row.EffectiveDistance, &row.Flags); err != nil {
+			rows.Close()
+			return err
+		}
+		cp.PendingActivity = append(cp.PendingActivity, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.db.Query(db.q("SELECT validator_idx FROM checkpoint_interesting WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var validator int
+		if err := rows.Scan(&validator); err != nil {
+			rows.Close()
+			return err
+		}
+		cp.InterestingValidators = append(cp.InterestingValidators, validator)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.db.Query(db.q("SELECT slot FROM checkpoint_empty_slot WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var slot int
+		if err := rows.Scan(&slot); err != nil {
+			rows.Close()
+			return err
+		}
+		cp.EmptySlots = append(cp.EmptySlots, slot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.db.Query(db.q("SELECT slot, epoch, proposer_idx, status, block_root FROM checkpoint_proposal WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p ProposalRow
+		if err := rows.Scan(&p.Slot, &p.Epoch, &p.ProposerIdx, &p.Status, &p.BlockRoot); err != nil {
+			rows.Close()
+			return err
+		}
+		cp.PendingProposals = append(cp.PendingProposals, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.db.Query(db.q("SELECT validator_idx, epoch, participated, missed, missed_slots FROM checkpoint_sync WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var s SyncRow
+		if err := rows.Scan(&s.ValidatorIdx, &s.Epoch, &s.Participated, &s.Missed, &s.MissedSlots); err != nil {
+			rows.Close()
+			return err
+		}
+		cp.PendingSync = append(cp.PendingSync, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.db.Query(db.q("SELECT slot, epoch, kind, position, validator_idx, pubkey, amount FROM checkpoint_event WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var e LifecycleRow
+		if err := rows.Scan(&e.Slot, &e.Epoch, &e.Kind, &e.Position, &e.ValidatorIdx, &e.Pubkey, &e.Amount); err != nil {
+			rows.Close()
+			return err
+		}
+		cp.PendingEvents = append(cp.PendingEvents, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.db.Query(db.q("SELECT slot, committee_index, validators FROM checkpoint_committee WHERE collector = ?"), db.collector)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CommitteeRow
+		var validators string
+		if err := rows.Scan(&c.Slot, &c.Index, &validators); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(validators), &c.Validators); err != nil {
+			return err
+		}
+		cp.Committees = append(cp.Committees, c)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testCheckpoint() *Checkpoint {
+	return &Checkpoint{
+		LastSlot:              100,
+		FirstSlotSeen:         64,
+		PendingActivity:       []ActivityRow{{ValidatorIdx: 7, Epoch: 3, Distance: 2, EffectiveDistance: 1, Flags: FlagTimelySource}},
+		InterestingValidators: []int{7},
+		EmptySlots:            []int{97},
+		PendingProposals:      []ProposalRow{{Slot: 97, Epoch: 3, ProposerIdx: 12, Status: ProposalMissed}},
+		PendingSync:           []SyncRow{{ValidatorIdx: 9, Epoch: 3, Participated: 3, Missed: 1, MissedSlots: 2}},
+		PendingEvents:         []LifecycleRow{{Slot: 98, Epoch: 3, Kind: EventVoluntaryExit, ValidatorIdx: 11, Pubkey: "0x11"}},
+		Committees:            []CommitteeRow{{Slot: 99, Index: 1, Validators: []int{7, 9, 11}}},
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, database *Database) {
+		if cp, err := database.LoadCheckpoint(); err != nil || cp != nil {
+			t.Fatalf("got checkpoint %+v (%v) from an empty database", cp, err)
+		}
+
+		cp := testCheckpoint()
+		if err := database.SaveCheckpoint(cp); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := database.LoadCheckpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, cp) {
+			t.Errorf("loaded %+v, expected %+v", loaded, cp)
+		}
+
+		// Saving again replaces the whole checkpoint
+		cp = &Checkpoint{LastSlot: 200, FirstSlotSeen: 64, InterestingValidators: []int{7, 8}}
+		if err := database.SaveCheckpoint(cp); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err = database.LoadCheckpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.LastSlot != 200 || len(loaded.InterestingValidators) != 2 || len(loaded.PendingActivity) != 0 || len(loaded.Committees) != 0 {
+			t.Errorf("the old checkpoint is still around: %+v", loaded)
+		}
+	})
+}
+
+func TestCheckpointPerCollector(t *testing.T) {
+	forEachSharedTestDatabase(t, func(t *testing.T, a *Database, b *Database) {
+		cpA := testCheckpoint()
+		cpB := &Checkpoint{
+			LastSlot:              300,
+			FirstSlotSeen:         256,
+			InterestingValidators: []int{7, 8},
+			EmptySlots:            []int{97},
+			PendingProposals:      []ProposalRow{{Slot: 97, Epoch: 3, ProposerIdx: 12, Status: ProposalMissed}},
+		}
+		if err := a.SaveCheckpoint(cpA); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SaveCheckpoint(cpB); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each collector gets its own checkpoint back
+		for _, test := range []struct {
+			database *Database
+			expected *Checkpoint
+		}{{a, cpA}, {b, cpB}} {
+			loaded, err := test.database.LoadCheckpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.LastSlot != test.expected.LastSlot || len(loaded.InterestingValidators) != len(test.expected.InterestingValidators) ||
+				len(loaded.PendingActivity) != len(test.expected.PendingActivity) || len(loaded.Committees) != len(test.expected.Committees) {
+				t.Errorf("collector %q loaded %+v, expected %+v", test.database.collector, loaded, test.expected)
+			}
+		}
+
+		// A collector we have never heard of starts from scratch
+		a.SetCollector("c")
+		if cp, err := a.LoadCheckpoint(); err != nil || cp != nil {
+			t.Errorf("got checkpoint %+v (%v) for a new collector", cp, err)
+		}
+	})
+}
+
+func TestCheckpointReplacesLegacyCheckpoint(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, database *Database) {
+		// A checkpoint saved by an older visit...
+		for _, stmt := range []string{
+			"INSERT INTO checkpoint_cursor(collector, last_slot, first_slot_seen) VALUES('', 100, 64)",
+			"INSERT INTO checkpoint_interesting(collector, validator_idx) VALUES('', 7)",
+		} {
+			if _, err := database.db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cp, err := database.LoadCheckpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || cp.LastSlot != 100 || len(cp.InterestingValidators) != 1 {
+			t.Fatalf("lost the legacy checkpoint: %+v", cp)
+		}
+
+		// ...makes way for the new one
+		if err := database.SaveCheckpoint(&Checkpoint{LastSlot: 132, FirstSlotSeen: 64}); err != nil {
+			t.Fatal(err)
+		}
+		var legacy int
+		if err := database.db.QueryRow("SELECT COUNT(*) FROM checkpoint_interesting").Scan(&legacy); err != nil {
+			t.Fatal(err)
+		}
+		if legacy != 0 {
+			t.Errorf("%d rows of the legacy checkpoint are still around", legacy)
+		}
+		if cp, err := database.LoadCheckpoint(); err != nil || cp.LastSlot != 132 {
+			t.Errorf("loaded %+v (%v), expected the checkpoint of slot #132", cp, err)
+		}
+	})
+}
+
+func TestCheckpointSize(t *testing.T) {
+	// Two epochs of pending activity of 100k validators
+	cp := &Checkpoint{LastSlot: 100}
+	for epoch := 2; epoch <= 3; epoch++ {
+		for validator := 0; validator < 100000; validator++ {
+			cp.PendingActivity = append(cp.PendingActivity, ActivityRow{
+				ValidatorIdx: validator, Epoch: epoch, Distance: 1 + validator%3, EffectiveDistance: 1, Flags: 7})
+		}
+	}
+
+	state, err := encodeCheckpoint(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) > 2*1024*1024 {
+		t.Errorf("the checkpoint takes %d bytes", len(state))
+	}
+	decoded, err := decodeCheckpoint(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, cp) {
+		t.Error("the checkpoint changed on the way")
+	}
+}
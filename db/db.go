@@ -3,60 +3,272 @@ package db
 import (
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
-)
+	"strings"
+
+	"github.com/asn-d6/visit/metrics"
 
-const (
-	databaseName = "./foo.db" // XXX rename...
+	// Registers the "sqlite3" driver
+	_ "github.com/mattn/go-sqlite3"
 )
 
+// Everything the trackers need from a storage backend
+type Storage interface {
+	// Register many (validator, epoch, inclusion distances, flags) rows at once
+	RegisterAttestations(rows []ActivityRow) error
+
+	// Store and load every duty observed in an epoch, in compact form
+	RegisterEpochDuties(epoch int, rows []ActivityRow) error
+	EpochDuties(epoch int) ([]ActivityRow, error)
+
+	// Register what happened to the block proposals of many slots at once
+	RegisterProposals(rows []ProposalRow) error
+
+	// Register the sync committee participation of many validators at once
+	RegisterSyncParticipation(rows []SyncRow) error
+
+	// Register the balances and rewards of many validators at once
+	RegisterRewards(rows []RewardRow) error
+
+	// Register many validator lifecycle events at once
+	RegisterLifecycleEvents(rows []LifecycleRow) error
+
+	// Register many slashable attestations at once
+	RegisterSlashings(rows []SlashingRow) error
+
+	// Register the duties of many watched validators at once
+	RegisterWatchlistDuties(rows []WatchDutyRow) error
+
+	// Read back what we stored (see ActivityFilter)
+	QueryActivity(f *ActivityFilter, fn func(ActivityRow) error) error
+	DutyEpochs(f *ActivityFilter) ([]int, error)
+	ValidatorPage(offset int, limit int) ([]int, int, error)
+	Epochs() ([]int, error)
+
+	// Store and load the state we need to resume collecting
+	SaveCheckpoint(cp *Checkpoint) error
+	LoadCheckpoint() (*Checkpoint, error)
+
+	Close() error
+}
+
+// A Storage on top of an SQL database (SQLite or PostgreSQL)
 type Database struct {
 	db *sql.DB
+
+	// The flavour of SQL we are talking
+	dialect *dialect
+
+	// How many rows to write per transaction in batch writes
+	batchSize int
+
+	// The collector whose checkpoints we save and load, when several of
+	// them share the database
+	collector string
 }
 
-// Open a database file and return its driver. If the file can't be found make
-// a new one
-func InitDatabase() *Database {
-	// Check if the db needs to be initialized (there is probably a better way)
-	need_to_initialize := false
-	if _, err := os.Stat(databaseName); os.IsNotExist(err) {
-		need_to_initialize = true
-	}
+// What differs between the SQL databases we support
+type dialect struct {
+	// Name of the database/sql driver
+	driver string
+
+	// Whether placeholders are numbered ($1, $2, ...) instead of being ?
+	numberedPlaceholders bool
 
+	// Migrations that bring the schema up to date. Schema versions mean
+	// the same thing in every dialect.
+	migrations []migration
+
+	// Statement that keeps other visits from migrating at the same time
+	// (empty if the database takes care of it by itself)
+	lockSchema string
+
+	// Suffix of a SELECT that keeps other visits from writing the rows it
+	// read until we are done (empty if writers take turns anyway)
+	lockRows string
+}
+
+var sqliteDialect = &dialect{
+	driver:     "sqlite3",
+	migrations: sqliteMigrations,
+}
+
+const defaultBatchSize = 10000
+
+// Something went wrong while talking to the database
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage failure while trying to %s: %v", e.Op, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Open the sqlite database file at `databaseName` and return its driver. If
+// the file can't be found make a new one. Either way, bring its schema up to
+// date.
+//
+// Batch writes are committed every `batchSize` rows (a sane default is used if
+// it's not positive).
+func InitDatabase(databaseName string, batchSize int) (*Database, error) {
 	// Open the db file (or make a new one if needed)
-	db, err := sql.Open("sqlite3", databaseName)
+	return openDatabase(sqliteDialect, databaseName, databaseName, batchSize)
+}
+
+// Open the database at `source` with the driver of `d`, and bring its schema
+// up to date. `name` is how we refer to the database in errors.
+func openDatabase(d *dialect, name string, source string, batchSize int) (*Database, error) {
+	db, err := sql.Open(d.driver, source)
 	if err != nil {
-		panic(err)
+		return nil, &StorageError{Op: "open " + name, Err: err}
 	}
 
-	if need_to_initialize {
-		// Initialize if needed
-		_, err = db.Exec("CREATE TABLE validator_state (validator_idx INTEGER, epoch INTEGER, distance INT)")
-		if err != nil {
-			panic(err)
-		}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
 	}
 
-	return &Database{
-		db: db,
+	database := &Database{
+		db:        db,
+		dialect:   d,
+		batchSize: batchSize,
+	}
+	if err := database.migrate(); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return database, nil
 }
 
+// Save and load the checkpoints of collector `id` (the unnamed collector by
+// default). Every collector sharing a database needs an id of its own.
+func (db *Database) SetCollector(id string) {
+	db.collector = id
+}
+
+// Rewrite `query` (written with ? placeholders) for our dialect
+func (db *Database) q(query string) string {
+	if !db.dialect.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Upsert a validator_state row. Another collector may have seen more of the
+// epoch than us: keep the shortest distances, every flag either of us saw,
+// and the status if we don't know it.
+const registerAttestationQuery = `INSERT INTO validator_state(validator_idx, epoch, distance, effective_distance, flags, validator_status) VALUES(?, ?, ?, ?, ?, ?)
+	ON CONFLICT (validator_idx, epoch) DO UPDATE SET
+		distance = CASE WHEN excluded.distance < validator_state.distance THEN excluded.distance ELSE validator_state.distance END,
+		effective_distance = CASE WHEN excluded.effective_distance < validator_state.effective_distance
+			THEN excluded.effective_distance ELSE validator_state.effective_distance END,
+		flags = validator_state.flags | excluded.flags,
+		validator_status = CASE WHEN excluded.validator_status = '' THEN validator_state.validator_status ELSE excluded.validator_status END`
+
 // Register an attestation by 'validator_idx' at 'epoch'
-func (db *Database) RegisterAttestation(validator_idx int, epoch int, distance int) {
+func (db *Database) RegisterAttestation(validator_idx int, epoch int, distance int, effective_distance int, flags int, validator_status string) error {
 	// XXX ewww this db.db thing is dirty
-	_, err := db.db.Exec("INSERT INTO validator_state(validator_idx, epoch, distance) VALUES(?, ?, ?)", validator_idx, epoch, distance)
+	_, err := db.db.Exec(db.q(registerAttestationQuery), validator_idx, epoch, distance, effective_distance, flags, validator_status)
+	if err != nil {
+		return &StorageError{Op: "register attestation", Err: err}
+	}
+	return nil
+}
+
+// Register many attestations at once
+func (db *Database) RegisterAttestations(rows []ActivityRow) error {
+	defer metrics.TimeDBWrite("register_attestations").ObserveDuration()
+
+	return db.writeRows("register attestations", registerAttestationQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.ValidatorIdx, row.Epoch, row.Distance, row.EffectiveDistance, row.Flags, row.ValidatorStatus}
+	})
+}
+
+// Run `fn` in a transaction, which gets committed if `fn` succeeds and rolled
+// back otherwise
+func (db *Database) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Write `n` rows with `query` (a prepared statement), `batchSize` rows per
+// transaction, which is a lot faster than writing them one by one.
+// `values(i)` returns the values of row `i`, and errors are StorageErrors of
+// `op`.
+func (db *Database) writeRows(op string, query string, n int, values func(i int) []interface{}) error {
+	for start := 0; start < n; start += db.batchSize {
+		end := start + db.batchSize
+		if end > n {
+			end = n
+		}
+		err := db.inTransaction(func(tx *sql.Tx) error {
+			return insertRows(tx, db.q(query), end-start, func(i int) []interface{} { return values(start + i) })
+		})
+		if err != nil {
+			return &StorageError{Op: op, Err: err}
+		}
+	}
+	return nil
+}
+
+// Insert `n` rows with the prepared statement `query`. `values(i)` returns
+// the values of row `i`.
+func insertRows(tx *sql.Tx, query string, n int, values func(i int) []interface{}) error {
+	if n == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(query)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		if _, err := stmt.Exec(values(i)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget everything we have registered about 'epoch'. Used before writing an
+// epoch, so that writing the same epoch twice (e.g. after resuming from a
+// checkpoint) does not duplicate its rows.
+func (db *Database) DeleteEpoch(epoch int) error {
+	_, err := db.db.Exec(db.q("DELETE FROM validator_state WHERE epoch = ?"), epoch)
+	if err != nil {
+		return &StorageError{Op: "delete epoch", Err: err}
+	}
+	return nil
 }
 
 // Cursed function XXX
-func (db *Database) QueryAttestations() {
+func (db *Database) QueryAttestations() error {
 	rows, err := db.db.Query("SELECT validator_idx, epoch, distance FROM validator_state")
 	if err != nil {
-		panic(err)
+		return &StorageError{Op: "query attestations", Err: err}
 	}
 	defer rows.Close()
 
@@ -66,12 +278,16 @@ func (db *Database) QueryAttestations() {
 		var distance int
 		err = rows.Scan(&id, &epoch, &distance)
 		if err != nil {
-			log.Fatal(err)
+			return &StorageError{Op: "query attestations", Err: err}
 		}
 		fmt.Println(id, epoch, distance)
 	}
+	return nil
 }
 
-func (db *Database) Close() {
-	db.db.Close()
+func (db *Database) Close() error {
+	if err := db.db.Close(); err != nil {
+		return &StorageError{Op: "close database", Err: err}
+	}
+	return nil
 }
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/asn-d6/visit/metrics"
+)
+
+// Inclusion distance that signals a missing validator
+const MissingDistance = 65535
+
+// Participation flags of a validator in an epoch (a bitfield, like in the
+// Altair spec): whether it got included with the correct source, target and
+// head vote, in time for each of them to count
+const (
+	FlagTimelySource = 1 << 0
+	FlagTimelyTarget = 1 << 1
+	FlagTimelyHead   = 1 << 2
+)
+
+// Compact encoding of every duty we observed in an epoch: one byte per
+// validator, at the offset of its validator index. This is way smaller than a
+// validator_state row per validator, and it tells apart validators that did
+// their duty perfectly from validators that had no duty we know of. The
+// effective inclusion distances and the participation flags are stored the
+// same way, in separate blobs.
+const (
+	DutyNone    = 0   // no duty observed
+	DutyMissing = 255 // never included
+	// Larger inclusion distances get clamped to this
+	dutyMaxDistance = 254
+)
+
+// Encode an inclusion distance as a duty
+func encodeDistance(distance int) byte {
+	switch {
+	case distance == MissingDistance:
+		return DutyMissing
+	case distance > dutyMaxDistance:
+		return dutyMaxDistance
+	}
+	return byte(distance)
+}
+
+// Encode the duties, the effective duties and the flags of `rows`
+func encodeDuties(rows []ActivityRow) ([]byte, []byte, []byte) {
+	size := 0
+	for _, row := range rows {
+		if row.ValidatorIdx+1 > size {
+			size = row.ValidatorIdx + 1
+		}
+	}
+
+	duties := make([]byte, size)
+	effective := make([]byte, size)
+	flags := make([]byte, size)
+	for _, row := range rows {
+		duties[row.ValidatorIdx] = encodeDistance(row.Distance)
+		effective[row.ValidatorIdx] = encodeDistance(row.EffectiveDistance)
+		flags[row.ValidatorIdx] = byte(row.Flags)
+	}
+	return duties, effective, flags
+}
+
+// Decode an inclusion distance out of a duty
+func decodeDistance(duty byte) int {
+	if duty == DutyMissing {
+		return MissingDistance
+	}
+	return int(duty)
+}
+
+// Decode the duties of `epoch`, ordered by validator index. `effective` and
+// `flags` are nil for epochs stored before we had them.
+func decodeDuties(epoch int, duties []byte, effective []byte, flags []byte) []ActivityRow {
+	var rows []ActivityRow
+	for validator, duty := range duties {
+		if duty == DutyNone {
+			continue
+		}
+		row := ActivityRow{ValidatorIdx: validator, Epoch: epoch, Distance: decodeDistance(duty)}
+		row.EffectiveDistance = row.Distance
+		if validator < len(effective) {
+			row.EffectiveDistance = decodeDistance(effective[validator])
+		}
+		if validator < len(flags) {
+			row.Flags = int(flags[validator])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Store every duty observed in `epoch` (the rows of every validator we saw in
+// a committee). The duties that were already stored for `epoch` (e.g. by
+// another collector) are merged with ours.
+func (db *Database) RegisterEpochDuties(epoch int, rows []ActivityRow) error {
+	defer metrics.TimeDBWrite("register_epoch_duties").ObserveDuration()
+
+	err := db.inTransaction(func(tx *sql.Tx) error {
+		return db.mergeEpochDuties(tx, epoch, rows)
+	})
+	if err != nil {
+		return &StorageError{Op: "register epoch duties", Err: err}
+	}
+	return nil
+}
+
+func (db *Database) mergeEpochDuties(tx *sql.Tx, epoch int, rows []ActivityRow) error {
+	// Make sure there is a row to lock, so that other collectors wait for
+	// us instead of both of us inserting it
+	if _, err := tx.Exec(db.q("INSERT INTO epoch_duties(epoch, duties) VALUES(?, ?) ON CONFLICT (epoch) DO NOTHING"), epoch, []byte{}); err != nil {
+		return err
+	}
+
+	var duties, effective, flags []byte
+	err := tx.QueryRow(db.q("SELECT duties, effective_duties, flags FROM epoch_duties WHERE epoch = ?"+db.dialect.lockRows), epoch).
+		Scan(&duties, &effective, &flags)
+	if err != nil {
+		return err
+	}
+
+	// Like the rows of validator_state, keep the shortest distances and
+	// every flag of what was stored and what we saw
+	stored := make(map[int]ActivityRow)
+	for _, row := range decodeDuties(epoch, duties, effective, flags) {
+		stored[row.ValidatorIdx] = row
+	}
+	merged := make([]ActivityRow, 0, len(rows)+len(stored))
+	for _, row := range rows {
+		if old, ok := stored[row.ValidatorIdx]; ok {
+			if old.Distance < row.Distance {
+				row.Distance = old.Distance
+			}
+			if old.EffectiveDistance < row.EffectiveDistance {
+				row.EffectiveDistance = old.EffectiveDistance
+			}
+			row.Flags |= old.Flags
+			delete(stored, row.ValidatorIdx)
+		}
+		merged = append(merged, row)
+	}
+	for _, row := range stored {
+		merged = append(merged, row)
+	}
+
+	duties, effective, flags = encodeDuties(merged)
+	_, err = tx.Exec(db.q("UPDATE epoch_duties SET duties = ?, effective_duties = ?, flags = ? WHERE epoch = ?"),
+		duties, effective, flags, epoch)
+	return err
+}
+
+// Load the duties stored for `epoch` (see RegisterEpochDuties()), ordered by
+// validator index. Returns nil if we don't have them.
+func (db *Database) EpochDuties(epoch int) ([]ActivityRow, error) {
+	var duties, effective, flags []byte
+	err := db.db.QueryRow(db.q("SELECT duties, effective_duties, flags FROM epoch_duties WHERE epoch = ?"), epoch).Scan(&duties, &effective, &flags)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, &StorageError{Op: "load epoch duties", Err: err}
+	}
+	return decodeDuties(epoch, duties, effective, flags), nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testDutyRows = []ActivityRow{
+	{ValidatorIdx: 0, Epoch: 5, Distance: 1, EffectiveDistance: 1, Flags: FlagTimelySource | FlagTimelyTarget | FlagTimelyHead},
+	{ValidatorIdx: 3, Epoch: 5, Distance: 4, EffectiveDistance: 2, Flags: FlagTimelySource},
+	{ValidatorIdx: 4, Epoch: 5, Distance: MissingDistance, EffectiveDistance: MissingDistance},
+	{ValidatorIdx: 9, Epoch: 5, Distance: 254, EffectiveDistance: 200, Flags: FlagTimelyTarget},
+}
+
+func TestEncodeDuties(t *testing.T) {
+	duties, effective, flags := encodeDuties(testDutyRows)
+
+	// One byte per validator up to the largest index, with gaps for the
+	// validators without a duty
+	expectedDuties := []byte{1, DutyNone, DutyNone, 4, DutyMissing, DutyNone, DutyNone, DutyNone, DutyNone, 254}
+	if !reflect.DeepEqual(duties, expectedDuties) {
+		t.Errorf("duties %v, expected %v", duties, expectedDuties)
+	}
+	if effective[3] != 2 || effective[4] != DutyMissing || effective[9] != 200 {
+		t.Errorf("wrong effective duties %v", effective)
+	}
+	if flags[0] != 7 || flags[3] != FlagTimelySource || flags[9] != FlagTimelyTarget {
+		t.Errorf("wrong flags %v", flags)
+	}
+
+	if rows := decodeDuties(5, duties, effective, flags); !reflect.DeepEqual(rows, testDutyRows) {
+		t.Errorf("decoded %v, expected %v", rows, testDutyRows)
+	}
+}
+
+func TestEncodeDutiesClampsDistances(t *testing.T) {
+	duties, effective, _ := encodeDuties([]ActivityRow{{ValidatorIdx: 0, Distance: 300, EffectiveDistance: 255}})
+	if duties[0] != 254 || effective[0] != 254 {
+		t.Errorf("got duty %d and effective duty %d, expected both clamped to 254", duties[0], effective[0])
+	}
+}
+
+func TestEncodeNoDuties(t *testing.T) {
+	duties, effective, flags := encodeDuties(nil)
+	if len(duties) != 0 || len(effective) != 0 || len(flags) != 0 {
+		t.Errorf("got %v, %v and %v for no rows", duties, effective, flags)
+	}
+	if rows := decodeDuties(5, duties, effective, flags); rows != nil {
+		t.Errorf("decoded %v out of nothing", rows)
+	}
+}
+
+func TestDecodeDutiesBeforeFlags(t *testing.T) {
+	// Epochs stored before we had effective distances and flags
+	rows := decodeDuties(1, []byte{DutyNone, 3, DutyMissing}, nil, nil)
+	expected := []ActivityRow{
+		{ValidatorIdx: 1, Epoch: 1, Distance: 3, EffectiveDistance: 3},
+		{ValidatorIdx: 2, Epoch: 1, Distance: MissingDistance, EffectiveDistance: MissingDistance},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("decoded %v, expected %v", rows, expected)
+	}
+}
+
+func TestEpochDuties(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, database *Database) {
+		if rows, err := database.EpochDuties(5); err != nil || rows != nil {
+			t.Fatalf("got %v (%v) for an epoch we don't have", rows, err)
+		}
+
+		if err := database.RegisterEpochDuties(5, testDutyRows); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := database.EpochDuties(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, testDutyRows) {
+			t.Errorf("loaded %v, expected %v", rows, testDutyRows)
+		}
+	})
+}
+
+func TestEpochDutiesOfSeveralCollectors(t *testing.T) {
+	forEachSharedTestDatabase(t, func(t *testing.T, a *Database, b *Database) {
+		// Each collector saw some of the committees...
+		if err := a.RegisterEpochDuties(5, testDutyRows[:2]); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.RegisterEpochDuties(5, testDutyRows[2:]); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := a.EpochDuties(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, testDutyRows) {
+			t.Errorf("loaded %v, expected %v", rows, testDutyRows)
+		}
+
+		// ...and the rows of a validator both of them saw get merged
+		update := []ActivityRow{
+			{ValidatorIdx: 0, Epoch: 5, Distance: MissingDistance, EffectiveDistance: MissingDistance},
+			{ValidatorIdx: 3, Epoch: 5, Distance: 1, EffectiveDistance: 1, Flags: FlagTimelyTarget},
+		}
+		if err := b.RegisterEpochDuties(5, update); err != nil {
+			t.Fatal(err)
+		}
+		rows, err = b.EpochDuties(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged := ActivityRow{ValidatorIdx: 3, Epoch: 5, Distance: 1, EffectiveDistance: 1, Flags: FlagTimelySource | FlagTimelyTarget}
+		expected := append([]ActivityRow{testDutyRows[0]}, merged, testDutyRows[2], testDutyRows[3])
+		if !reflect.DeepEqual(rows, expected) {
+			t.Errorf("loaded %v, expected %v", rows, expected)
+		}
+	})
+}
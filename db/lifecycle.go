@@ -0,0 +1,65 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/asn-d6/visit/metrics"
+)
+
+// Kinds of validator lifecycle events we find in blocks
+const (
+	EventDeposit          = "deposit"
+	EventVoluntaryExit    = "voluntary_exit"
+	EventProposerSlashing = "proposer_slashing"
+	EventAttesterSlashing = "attester_slashing"
+)
+
+// Validator index of deposits (the block only tells us the pubkey, and new
+// validators don't have an index yet)
+const UnknownValidator = -1
+
+// Statuses of validators (as the beacon API calls them) that are still
+// expected to do their duties: active_ongoing, active_exiting and
+// active_slashed are all still in committees, and still get penalized for
+// missing them
+const (
+	StatusActiveOngoing = "active_ongoing"
+	StatusActive        = "active" // older nodes, and the prefix of the rest
+)
+
+// Whether a validator with `status` is still expected to do its duties. An
+// unknown (empty) status gets the benefit of the doubt.
+func StatusIsActive(status string) bool {
+	return status == "" || strings.HasPrefix(status, StatusActive)
+}
+
+// A lifecycle event of a validator, found in the block of `Slot`
+type LifecycleRow struct {
+	Slot  int
+	Epoch int
+	Kind  string
+
+	// Position of the operation in its list of the block body (a block can
+	// carry more than one of each kind)
+	Position int
+
+	ValidatorIdx int
+
+	// Only set for deposits
+	Pubkey string
+	Amount int64
+}
+
+// Insert a validator_events row (events don't change once a block is final)
+const registerLifecycleQuery = `INSERT INTO validator_events(slot, epoch, kind, position, validator_idx, pubkey, amount) VALUES(?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (slot, kind, position, validator_idx) DO NOTHING`
+
+// Register many lifecycle events at once
+func (db *Database) RegisterLifecycleEvents(rows []LifecycleRow) error {
+	defer metrics.TimeDBWrite("register_lifecycle_events").ObserveDuration()
+
+	return db.writeRows("register lifecycle events", registerLifecycleQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.Slot, row.Epoch, row.Kind, row.Position, row.ValidatorIdx, row.Pubkey, row.Amount}
+	})
+}
@@ -0,0 +1,297 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// A step that takes the schema from one version to the next
+type migration struct {
+	description string
+	statements  []string
+}
+
+// Every schema change goes at the end of this list, never in the middle. The
+// schema version of a database is the number of migrations applied to it.
+// Every schema change must also be added to postgresMigrations.
+//
+// Databases made before we had schema versions already have the tables of the
+// first migrations, hence the IF NOT EXISTS.
+var sqliteMigrations = []migration{
+	{
+		"create validator_state",
+		[]string{
+			"CREATE TABLE IF NOT EXISTS validator_state (validator_idx INTEGER, epoch INTEGER, distance INT)",
+		},
+	},
+	{
+		"create checkpoint tables",
+		[]string{
+			"CREATE TABLE IF NOT EXISTS checkpoint_cursor (id INTEGER PRIMARY KEY CHECK (id = 0), last_slot INTEGER, first_slot_seen INTEGER)",
+			"CREATE TABLE IF NOT EXISTS checkpoint_activity (validator_idx INTEGER, epoch INTEGER, distance INT)",
+			"CREATE TABLE IF NOT EXISTS checkpoint_interesting (validator_idx INTEGER PRIMARY KEY)",
+			"CREATE TABLE IF NOT EXISTS checkpoint_committee (slot INTEGER, committee_index INTEGER, validators TEXT)",
+		},
+	},
+	{
+		"key validator_state on (validator_idx, epoch) and index it for the visualization queries",
+		[]string{
+			`CREATE TABLE validator_state_new (
+				validator_idx INTEGER NOT NULL,
+				epoch INTEGER NOT NULL,
+				distance INT NOT NULL,
+				PRIMARY KEY (validator_idx, epoch)
+			) WITHOUT ROWID`,
+			// If an old database has duplicates, the latest row wins
+			"INSERT OR REPLACE INTO validator_state_new SELECT validator_idx, epoch, distance FROM validator_state ORDER BY rowid",
+			"DROP TABLE validator_state",
+			"ALTER TABLE validator_state_new RENAME TO validator_state",
+			// Counting and paging through epochs (the primary key already
+			// covers ordering and counting by validator)
+			"CREATE INDEX validator_state_epoch ON validator_state(epoch)",
+		},
+	},
+	{
+		"create epoch_duties",
+		[]string{
+			// One blob per epoch, see RegisterEpochDuties()
+			"CREATE TABLE epoch_duties (epoch INTEGER PRIMARY KEY, duties BLOB NOT NULL)",
+		},
+	},
+	{
+		"add participation flags",
+		[]string{
+			"ALTER TABLE validator_state ADD COLUMN flags INT NOT NULL DEFAULT 0",
+			"ALTER TABLE checkpoint_activity ADD COLUMN flags INT NOT NULL DEFAULT 0",
+			// One byte per validator, like the duties
+			"ALTER TABLE epoch_duties ADD COLUMN flags BLOB",
+		},
+	},
+	{
+		"add effective inclusion distances",
+		[]string{
+			// Old rows were never told about empty slots
+			"ALTER TABLE validator_state ADD COLUMN effective_distance INT NOT NULL DEFAULT 0",
+			"UPDATE validator_state SET effective_distance = distance",
+			"ALTER TABLE checkpoint_activity ADD COLUMN effective_distance INT NOT NULL DEFAULT 0",
+			"UPDATE checkpoint_activity SET effective_distance = distance",
+			"ALTER TABLE epoch_duties ADD COLUMN effective_duties BLOB",
+			"CREATE TABLE checkpoint_empty_slot (slot INTEGER PRIMARY KEY)",
+		},
+	},
+	{
+		"create block_proposals",
+		[]string{
+			`CREATE TABLE block_proposals (
+				slot INTEGER PRIMARY KEY,
+				epoch INTEGER NOT NULL,
+				proposer_idx INTEGER NOT NULL,
+				status TEXT NOT NULL,
+				block_root TEXT NOT NULL
+			)`,
+			"CREATE INDEX block_proposals_epoch ON block_proposals(epoch)",
+			"CREATE TABLE checkpoint_proposal (slot INTEGER PRIMARY KEY, epoch INTEGER, proposer_idx INTEGER, status TEXT, block_root TEXT)",
+		},
+	},
+	{
+		"create sync_participation",
+		[]string{
+			`CREATE TABLE sync_participation (
+				validator_idx INTEGER NOT NULL,
+				epoch INTEGER NOT NULL,
+				participated INT NOT NULL,
+				missed INT NOT NULL,
+				missed_slots INTEGER NOT NULL,
+				PRIMARY KEY (validator_idx, epoch)
+			)`,
+			"CREATE TABLE checkpoint_sync (validator_idx INTEGER, epoch INTEGER, participated INT, missed INT, missed_slots INTEGER)",
+		},
+	},
+	{
+		"create validator_rewards",
+		[]string{
+			`CREATE TABLE validator_rewards (
+				validator_idx INTEGER NOT NULL,
+				epoch INTEGER NOT NULL,
+				balance INTEGER NOT NULL,
+				delta INTEGER NOT NULL,
+				attestation_reward INTEGER NOT NULL,
+				proposal_reward INTEGER NOT NULL,
+				sync_reward INTEGER NOT NULL,
+				penalties INTEGER NOT NULL,
+				PRIMARY KEY (validator_idx, epoch)
+			)`,
+		},
+	},
+	{
+		"create validator_events and add validator statuses",
+		[]string{
+			`CREATE TABLE validator_events (
+				slot INTEGER NOT NULL,
+				epoch INTEGER NOT NULL,
+				kind TEXT NOT NULL,
+				position INT NOT NULL,
+				validator_idx INTEGER NOT NULL,
+				pubkey TEXT NOT NULL,
+				amount INTEGER NOT NULL,
+				PRIMARY KEY (slot, kind, position, validator_idx)
+			)`,
+			"CREATE INDEX validator_events_validator ON validator_events(validator_idx)",
+			"CREATE TABLE checkpoint_event (slot INTEGER, epoch INTEGER, kind TEXT, position INT, validator_idx INTEGER, pubkey TEXT, amount INTEGER)",
+			"ALTER TABLE validator_state ADD COLUMN validator_status TEXT NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		"create slashable_votes",
+		[]string{
+			`CREATE TABLE slashable_votes (
+				validator_idx INTEGER NOT NULL,
+				kind TEXT NOT NULL,
+				slot_1 INTEGER NOT NULL,
+				source_1 INTEGER NOT NULL,
+				target_1 INTEGER NOT NULL,
+				block_slot_1 INTEGER NOT NULL,
+				slot_2 INTEGER NOT NULL,
+				source_2 INTEGER NOT NULL,
+				target_2 INTEGER NOT NULL,
+				block_slot_2 INTEGER NOT NULL,
+				PRIMARY KEY (validator_idx, kind, source_1, target_1, source_2, target_2)
+			)`,
+		},
+	},
+	{
+		"create watchlist_duties",
+		[]string{
+			`CREATE TABLE watchlist_duties (
+				validator_idx INTEGER NOT NULL,
+				epoch INTEGER NOT NULL,
+				slot INTEGER NOT NULL,
+				committee_index INT NOT NULL,
+				position INT NOT NULL,
+				inclusion_slot INTEGER NOT NULL,
+				distance INT NOT NULL,
+				effective_distance INT NOT NULL,
+				flags INT NOT NULL,
+				PRIMARY KEY (validator_idx, epoch)
+			)`,
+		},
+	},
+	{
+		"key the checkpoint tables by collector",
+		[]string{
+			// The checkpoint we had belongs to the unnamed collector
+			"CREATE TABLE checkpoint_cursor_new (collector TEXT PRIMARY KEY, last_slot INTEGER, first_slot_seen INTEGER)",
+			"INSERT INTO checkpoint_cursor_new SELECT '', last_slot, first_slot_seen FROM checkpoint_cursor",
+			"DROP TABLE checkpoint_cursor",
+			"ALTER TABLE checkpoint_cursor_new RENAME TO checkpoint_cursor",
+
+			"CREATE TABLE checkpoint_interesting_new (collector TEXT NOT NULL, validator_idx INTEGER, PRIMARY KEY (collector, validator_idx))",
+			"INSERT INTO checkpoint_interesting_new SELECT '', validator_idx FROM checkpoint_interesting",
+			"DROP TABLE checkpoint_interesting",
+			"ALTER TABLE checkpoint_interesting_new RENAME TO checkpoint_interesting",
+
+			"CREATE TABLE checkpoint_empty_slot_new (collector TEXT NOT NULL, slot INTEGER, PRIMARY KEY (collector, slot))",
+			"INSERT INTO checkpoint_empty_slot_new SELECT '', slot FROM checkpoint_empty_slot",
+			"DROP TABLE checkpoint_empty_slot",
+			"ALTER TABLE checkpoint_empty_slot_new RENAME TO checkpoint_empty_slot",
+
+			"CREATE TABLE checkpoint_proposal_new (collector TEXT NOT NULL, slot INTEGER, epoch INTEGER, proposer_idx INTEGER, status TEXT, block_root TEXT, PRIMARY KEY (collector, slot))",
+			"INSERT INTO checkpoint_proposal_new SELECT '', slot, epoch, proposer_idx, status, block_root FROM checkpoint_proposal",
+			"DROP TABLE checkpoint_proposal",
+			"ALTER TABLE checkpoint_proposal_new RENAME TO checkpoint_proposal",
+
+			"ALTER TABLE checkpoint_activity ADD COLUMN collector TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE checkpoint_committee ADD COLUMN collector TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE checkpoint_sync ADD COLUMN collector TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE checkpoint_event ADD COLUMN collector TEXT NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		"store checkpoints as one blob per collector",
+		[]string{
+			// The checkpoint_* tables stay around for the checkpoints we
+			// had, see LoadCheckpoint()
+			"CREATE TABLE checkpoint_state (collector TEXT PRIMARY KEY, last_slot INTEGER NOT NULL, state BLOB NOT NULL)",
+		},
+	},
+}
+
+// Return the schema version of the database (zero for a fresh or unversioned one)
+func (db *Database) schemaVersion() (int, error) {
+	if _, err := db.db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Apply migration number `version` (counting from one) and record it. Does
+// nothing if another visit sharing the database got there first.
+func (db *Database) applyMigration(version int, m migration) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if db.dialect.lockSchema != "" {
+		if _, err := tx.Exec(db.dialect.lockSchema); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var current int
+	err = tx.QueryRow("SELECT version FROM schema_version").Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if current >= version {
+		return tx.Rollback()
+	}
+
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(db.q("INSERT INTO schema_version(version) VALUES(?)"), version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Bring the schema of the database up to date. Progress goes to stderr, since
+// stdout can be where `visit export` writes its data.
+func (db *Database) migrate() error {
+	version, err := db.schemaVersion()
+	if err != nil {
+		return &StorageError{Op: "read schema version", Err: err}
+	}
+
+	migrations := db.dialect.migrations
+	if version > len(migrations) {
+		return &StorageError{Op: "migrate", Err: fmt.Errorf("database schema version %d is newer than this visit (%d)", version, len(migrations))}
+	}
+
+	for i := version; i < len(migrations); i++ {
+		fmt.Fprintf(os.Stderr, "[!] Migrating database to schema version %d: %s\n", i+1, migrations[i].description)
+		if err := db.applyMigration(i+1, migrations[i]); err != nil {
+			return &StorageError{Op: "migrate to schema version " + fmt.Sprint(i+1), Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestMigrationsOfBothDialectsMatch(t *testing.T) {
+	if len(sqliteMigrations) != len(postgresMigrations) {
+		t.Fatalf("%d sqlite migrations but %d postgres migrations", len(sqliteMigrations), len(postgresMigrations))
+	}
+	for i := range sqliteMigrations {
+		if sqliteMigrations[i].description != postgresMigrations[i].description {
+			t.Errorf("migration %d is %q in sqlite but %q in postgres", i+1,
+				sqliteMigrations[i].description, postgresMigrations[i].description)
+		}
+	}
+}
+
+func checkSchemaVersion(t *testing.T, database *Database, expected int) {
+	t.Helper()
+	version, err := database.schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != expected {
+		t.Errorf("schema version %d, expected %d", version, expected)
+	}
+}
+
+// Check that validator 1 has a row for epoch 2 with a distance of 3, brought
+// up to date by the migrations
+func checkMigratedRow(t *testing.T, database *Database) {
+	t.Helper()
+	var distance, effective, flags int
+	var status string
+	err := database.db.QueryRow("SELECT distance, effective_distance, flags, validator_status FROM validator_state WHERE validator_idx = 1 AND epoch = 2").
+		Scan(&distance, &effective, &flags, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance != 3 || effective != 3 || flags != 0 || status != "" {
+		t.Errorf("got distance %d, effective distance %d, flags %d and status %q", distance, effective, flags, status)
+	}
+}
+
+func TestMigrateFromEveryVersion(t *testing.T) {
+	forEachTestDialect(t, func(t *testing.T, d *dialect, newSource func() string) {
+		for version := 0; version <= len(d.migrations); version++ {
+			source := newSource()
+
+			// A database of an older visit...
+			old := *d
+			old.migrations = d.migrations[:version]
+			database, err := openDatabase(&old, d.driver, source, 0)
+			if err != nil {
+				t.Fatalf("migrating to version %d: %v", version, err)
+			}
+			if version == 1 {
+				if _, err := database.db.Exec("INSERT INTO validator_state(validator_idx, epoch, distance) VALUES(1, 2, 3)"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			database.Close()
+
+			// ...opened by this one
+			database, err = openDatabase(d, d.driver, source, 0)
+			if err != nil {
+				t.Fatalf("migrating from version %d: %v", version, err)
+			}
+			checkSchemaVersion(t, database, len(d.migrations))
+			if version == 1 {
+				checkMigratedRow(t, database)
+			}
+			database.Close()
+		}
+	})
+}
+
+func TestMigrateUnversionedSqlite(t *testing.T) {
+	forEachTestDialect(t, func(t *testing.T, d *dialect, newSource func() string) {
+		if d != sqliteDialect {
+			t.Skip("only sqlite databases predate schema versions")
+		}
+		source := newSource()
+
+		// What visit used to make, duplicates included
+		legacy, err := sql.Open(d.driver, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range []string{
+			"CREATE TABLE validator_state (validator_idx INTEGER, epoch INTEGER, distance INT)",
+			"INSERT INTO validator_state VALUES(1, 2, 5)",
+			"INSERT INTO validator_state VALUES(1, 2, 3)",
+		} {
+			if _, err := legacy.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		legacy.Close()
+
+		database, err := InitDatabase(source, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer database.Close()
+		checkSchemaVersion(t, database, len(d.migrations))
+		checkMigratedRow(t, database)
+
+		var rows int
+		if err := database.db.QueryRow("SELECT COUNT(*) FROM validator_state").Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != 1 {
+			t.Errorf("got %d rows, expected the duplicates to be merged", rows)
+		}
+	})
+}
+
+func TestMigrateUpToDate(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, database *Database) {
+		if err := database.migrate(); err != nil {
+			t.Fatal(err)
+		}
+		checkSchemaVersion(t, database, len(database.dialect.migrations))
+	})
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, database *Database) {
+		if _, err := database.db.Exec("UPDATE schema_version SET version = version + 1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.migrate(); err == nil {
+			t.Error("migrated a database made by a newer visit")
+		}
+	})
+}
+
+func TestMigrateCheckpointToCollector(t *testing.T) {
+	forEachTestDialect(t, func(t *testing.T, d *dialect, newSource func() string) {
+		version := 0
+		for i, m := range d.migrations {
+			if m.description == "key the checkpoint tables by collector" {
+				version = i
+			}
+		}
+		source := newSource()
+
+		// The checkpoint of a visit from before collectors...
+		old := *d
+		old.migrations = d.migrations[:version]
+		database, err := openDatabase(&old, d.driver, source, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range []string{
+			"INSERT INTO checkpoint_cursor(id, last_slot, first_slot_seen) VALUES(0, 100, 64)",
+			"INSERT INTO checkpoint_interesting(validator_idx) VALUES(7)",
+			"INSERT INTO checkpoint_proposal(slot, epoch, proposer_idx, status, block_root) VALUES(97, 3, 12, 'missed', '')",
+		} {
+			if _, err := database.db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		database.Close()
+
+		// ...belongs to the unnamed collector
+		database, err = openDatabase(d, d.driver, source, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer database.Close()
+		cp, err := database.LoadCheckpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || cp.LastSlot != 100 || len(cp.InterestingValidators) != 1 || len(cp.PendingProposals) != 1 {
+			t.Errorf("lost the checkpoint: %+v", cp)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"github.com/asn-d6/visit/metrics"
+)
+
+// What happened to the block proposal of a slot
+const (
+	ProposalProposed = "proposed" // the block made it into the chain
+	ProposalMissed   = "missed"   // no block was published
+	ProposalOrphaned = "orphaned" // a block was published but the chain moved on without it
+)
+
+// Proposer index of slots whose proposer duties we couldn't get
+const UnknownProposer = -1
+
+// A row of block_proposals
+type ProposalRow struct {
+	Slot  int
+	Epoch int
+
+	// The validator that was supposed to propose (UnknownProposer if we
+	// don't know)
+	ProposerIdx int
+
+	// One of ProposalProposed, ProposalMissed or ProposalOrphaned
+	Status string
+
+	// Root of the block we saw for the slot (empty if it was missed)
+	BlockRoot string
+}
+
+// Upsert a block_proposals row. A collector that saw no block may just have
+// missed it: a block (proposed or orphaned) wins over a missed slot, and a
+// known proposer over an unknown one.
+const registerProposalQuery = `INSERT INTO block_proposals(slot, epoch, proposer_idx, status, block_root) VALUES(?, ?, ?, ?, ?)
+	ON CONFLICT (slot) DO UPDATE SET epoch = excluded.epoch,
+		proposer_idx = CASE WHEN excluded.proposer_idx = -1 THEN block_proposals.proposer_idx ELSE excluded.proposer_idx END,
+		status = CASE WHEN excluded.status = '` + ProposalMissed + `' THEN block_proposals.status ELSE excluded.status END,
+		block_root = CASE WHEN excluded.status = '` + ProposalMissed + `' THEN block_proposals.block_root ELSE excluded.block_root END`
+
+// Register what happened to the proposals of many slots at once
+func (db *Database) RegisterProposals(rows []ProposalRow) error {
+	defer metrics.TimeDBWrite("register_proposals").ObserveDuration()
+
+	return db.writeRows("register proposals", registerProposalQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.Slot, row.Epoch, row.ProposerIdx, row.Status, row.BlockRoot}
+	})
+}
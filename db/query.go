@@ -0,0 +1,203 @@
+package db
+
+import (
+	"math"
+)
+
+// Status of a validator in an epoch, according to its (effective) inclusion
+// distance
+const (
+	StatusPerfect  = "perfect"
+	StatusSlow     = "slow"
+	StatusMissing  = "missing"
+	StatusInactive = "inactive" // missing, but not expected to attest anymore
+)
+
+// `validatorStatus` is the status of the validator according to the beacon
+// node (empty if unknown), see StatusIsActive()
+func DistanceStatus(distance int, validatorStatus string) string {
+	if distance == MissingDistance {
+		if !StatusIsActive(validatorStatus) {
+			return StatusInactive
+		}
+		return StatusMissing
+	} else if distance > 1 {
+		return StatusSlow
+	}
+	return StatusPerfect
+}
+
+// Which activity rows we want to read
+type ActivityFilter struct {
+	// Epoch range (inclusive). Negative values mean no bound.
+	FromEpoch int
+	ToEpoch   int
+
+	// Only these validators (all of them if empty)
+	Validators []int
+
+	// Only rows with this status (all of them if empty)
+	Status string
+
+	validatorSet map[int]bool
+}
+
+// Does `row` pass the filter?
+func (f *ActivityFilter) Matches(row ActivityRow) bool {
+	if f.FromEpoch >= 0 && row.Epoch < f.FromEpoch {
+		return false
+	}
+	if f.ToEpoch >= 0 && row.Epoch > f.ToEpoch {
+		return false
+	}
+	if f.Status != "" && DistanceStatus(row.EffectiveDistance, row.ValidatorStatus) != f.Status {
+		return false
+	}
+	if len(f.Validators) > 0 {
+		if f.validatorSet == nil {
+			f.validatorSet = make(map[int]bool)
+			for _, validator := range f.Validators {
+				f.validatorSet[validator] = true
+			}
+		}
+		if !f.validatorSet[row.ValidatorIdx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Turn the epoch range of `f` into SQL parameters
+func (f *ActivityFilter) epochBounds() (int, int) {
+	from, to := f.FromEpoch, f.ToEpoch
+	if from < 0 {
+		from = 0
+	}
+	if to < 0 {
+		to = math.MaxInt32
+	}
+	return from, to
+}
+
+// Turn the validators of `f` into a range of validator indices for SQL
+func (f *ActivityFilter) validatorBounds() (int, int) {
+	if len(f.Validators) == 0 {
+		return 0, math.MaxInt32
+	}
+	first, last := f.Validators[0], f.Validators[0]
+	for _, validator := range f.Validators {
+		if validator < first {
+			first = validator
+		}
+		if validator > last {
+			last = validator
+		}
+	}
+	return first, last
+}
+
+// Call `fn` with every validator_state row that matches `f`, ordered by epoch
+// and then by validator index. Stops at the first error of `fn`.
+func (db *Database) QueryActivity(f *ActivityFilter, fn func(ActivityRow) error) error {
+	from, to := f.epochBounds()
+	first, last := f.validatorBounds()
+	rows, err := db.db.Query(db.q("SELECT validator_idx, epoch, distance, effective_distance, flags, validator_status FROM validator_state"+
+		" WHERE epoch >= ? AND epoch <= ? AND validator_idx >= ? AND validator_idx <= ?"+
+		" ORDER BY epoch, validator_idx"), from, to, first, last)
+	if err != nil {
+		return &StorageError{Op: "query activity", Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row ActivityRow
+		if err := rows.Scan(&row.ValidatorIdx, &row.Epoch, &row.Distance, &row.EffectiveDistance, &row.Flags, &row.ValidatorStatus); err != nil {
+			return &StorageError{Op: "query activity", Err: err}
+		}
+		if !f.Matches(row) {
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &StorageError{Op: "query activity", Err: err}
+	}
+	return nil
+}
+
+// Return the epochs within the epoch range of `f` that we have duties stored
+// for, in order
+func (db *Database) DutyEpochs(f *ActivityFilter) ([]int, error) {
+	from, to := f.epochBounds()
+	rows, err := db.db.Query(db.q("SELECT epoch FROM epoch_duties WHERE epoch >= ? AND epoch <= ? ORDER BY epoch"), from, to)
+	if err != nil {
+		return nil, &StorageError{Op: "query duty epochs", Err: err}
+	}
+	defer rows.Close()
+
+	var epochs []int
+	for rows.Next() {
+		var epoch int
+		if err := rows.Scan(&epoch); err != nil {
+			return nil, &StorageError{Op: "query duty epochs", Err: err}
+		}
+		epochs = append(epochs, epoch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &StorageError{Op: "query duty epochs", Err: err}
+	}
+	return epochs, nil
+}
+
+// Return `limit` of the validators we have validator_state rows for, ordered
+// by validator index and skipping the first `offset` of them. Also return how
+// many validators there are in total.
+func (db *Database) ValidatorPage(offset int, limit int) ([]int, int, error) {
+	var total int
+	if err := db.db.QueryRow("SELECT COUNT(DISTINCT validator_idx) FROM validator_state").Scan(&total); err != nil {
+		return nil, 0, &StorageError{Op: "count validators", Err: err}
+	}
+
+	rows, err := db.db.Query(db.q("SELECT DISTINCT validator_idx FROM validator_state ORDER BY validator_idx LIMIT ? OFFSET ?"), limit, offset)
+	if err != nil {
+		return nil, 0, &StorageError{Op: "query validators", Err: err}
+	}
+	defer rows.Close()
+
+	validators := []int{}
+	for rows.Next() {
+		var validator int
+		if err := rows.Scan(&validator); err != nil {
+			return nil, 0, &StorageError{Op: "query validators", Err: err}
+		}
+		validators = append(validators, validator)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, &StorageError{Op: "query validators", Err: err}
+	}
+	return validators, total, nil
+}
+
+// Return the epochs we have validator_state rows for, in order
+func (db *Database) Epochs() ([]int, error) {
+	rows, err := db.db.Query("SELECT DISTINCT epoch FROM validator_state ORDER BY epoch")
+	if err != nil {
+		return nil, &StorageError{Op: "query epochs", Err: err}
+	}
+	defer rows.Close()
+
+	epochs := []int{}
+	for rows.Next() {
+		var epoch int
+		if err := rows.Scan(&epoch); err != nil {
+			return nil, &StorageError{Op: "query epochs", Err: err}
+		}
+		epochs = append(epochs, epoch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &StorageError{Op: "query epochs", Err: err}
+	}
+	return epochs, nil
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestDistanceStatus(t *testing.T) {
+	for _, test := range []struct {
+		distance int
+		status   string
+		expected string
+	}{
+		{1, "", StatusPerfect},
+		{3, "", StatusSlow},
+		{MissingDistance, "", StatusMissing},
+		{MissingDistance, StatusActiveOngoing, StatusMissing},
+		{MissingDistance, "active_exiting", StatusMissing},
+		{MissingDistance, "active_slashed", StatusMissing},
+		{MissingDistance, "pending_queued", StatusInactive},
+		{MissingDistance, "exited_unslashed", StatusInactive},
+	} {
+		if status := DistanceStatus(test.distance, test.status); status != test.expected {
+			t.Errorf("distance %d of a %q validator is %q, expected %q", test.distance, test.status, status, test.expected)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"github.com/asn-d6/visit/metrics"
+)
+
+// What a validator earned or lost in an epoch, in Gwei
+type RewardRow struct {
+	ValidatorIdx int
+	Epoch        int
+
+	// Balance at the end of the epoch, and how much it changed over it
+	Balance int64
+	Delta   int64
+
+	// Rewards for the duties of the epoch. Attestation rewards only land in
+	// the balance at the end of the next epoch, so they don't add up to
+	// Delta exactly.
+	AttestationReward int64
+	ProposalReward    int64
+	SyncReward        int64
+
+	// Penalties for the duties of the epoch (zero or negative)
+	Penalties int64
+}
+
+// Upsert a validator_rewards row
+const registerRewardQuery = `INSERT INTO validator_rewards(validator_idx, epoch, balance, delta,
+		attestation_reward, proposal_reward, sync_reward, penalties) VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (validator_idx, epoch) DO UPDATE SET balance = excluded.balance, delta = excluded.delta,
+		attestation_reward = excluded.attestation_reward, proposal_reward = excluded.proposal_reward,
+		sync_reward = excluded.sync_reward, penalties = excluded.penalties`
+
+// Register the balances and rewards of many validators at once
+func (db *Database) RegisterRewards(rows []RewardRow) error {
+	defer metrics.TimeDBWrite("register_rewards").ObserveDuration()
+
+	return db.writeRows("register rewards", registerRewardQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.ValidatorIdx, row.Epoch, row.Balance, row.Delta,
+			row.AttestationReward, row.ProposalReward, row.SyncReward, row.Penalties}
+	})
+}
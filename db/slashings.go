@@ -0,0 +1,45 @@
+package db
+
+import (
+	"github.com/asn-d6/visit/metrics"
+)
+
+// Kinds of slashable attestations
+const (
+	SlashableDoubleVote   = "double_vote"
+	SlashableSurroundVote = "surround_vote"
+)
+
+// A pair of conflicting votes of a validator that we saw on chain. Vote 1 is
+// the one we saw first. Each vote comes with the slot of the block we saw it
+// in, to dig out the attestations themselves.
+type SlashingRow struct {
+	ValidatorIdx int
+	Kind         string
+
+	Slot1      int
+	Source1    int
+	Target1    int
+	BlockSlot1 int
+
+	Slot2      int
+	Source2    int
+	Target2    int
+	BlockSlot2 int
+}
+
+// Insert a slashable_votes row (we only keep the first time we saw a pair)
+const registerSlashingQuery = `INSERT INTO slashable_votes(validator_idx, kind, slot_1, source_1, target_1, block_slot_1,
+		slot_2, source_2, target_2, block_slot_2) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (validator_idx, kind, source_1, target_1, source_2, target_2) DO NOTHING`
+
+// Register many slashable attestations at once
+func (db *Database) RegisterSlashings(rows []SlashingRow) error {
+	defer metrics.TimeDBWrite("register_slashings").ObserveDuration()
+
+	return db.writeRows("register slashings", registerSlashingQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.ValidatorIdx, row.Kind, row.Slot1, row.Source1, row.Target1, row.BlockSlot1,
+			row.Slot2, row.Source2, row.Target2, row.BlockSlot2}
+	})
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"github.com/asn-d6/visit/metrics"
+)
+
+// How a member of the sync committee did in an epoch
+type SyncRow struct {
+	ValidatorIdx int
+	Epoch        int
+
+	// In how many blocks of the epoch its signature was included or not (a
+	// validator can sit in the committee more than once)
+	Participated int
+	Missed       int
+
+	// Bitmask of the slots of the epoch (by their index within the epoch)
+	// whose block did not include its signature
+	MissedSlots int64
+}
+
+// Upsert a sync_participation row. Collectors that saw different blocks of the
+// epoch each counted some of them: keep the highest counts, and every slot
+// either of them saw missed.
+const registerSyncQuery = `INSERT INTO sync_participation(validator_idx, epoch, participated, missed, missed_slots) VALUES(?, ?, ?, ?, ?)
+	ON CONFLICT (validator_idx, epoch) DO UPDATE SET
+		participated = CASE WHEN excluded.participated > sync_participation.participated
+			THEN excluded.participated ELSE sync_participation.participated END,
+		missed = CASE WHEN excluded.missed > sync_participation.missed THEN excluded.missed ELSE sync_participation.missed END,
+		missed_slots = sync_participation.missed_slots | excluded.missed_slots`
+
+// Register the sync committee participation of many validators at once
+func (db *Database) RegisterSyncParticipation(rows []SyncRow) error {
+	defer metrics.TimeDBWrite("register_sync_participation").ObserveDuration()
+
+	return db.writeRows("register sync participation", registerSyncQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.ValidatorIdx, row.Epoch, row.Participated, row.Missed, row.MissedSlots}
+	})
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"github.com/asn-d6/visit/metrics"
+)
+
+// The full detail of the duty of a watched validator in an epoch
+type WatchDutyRow struct {
+	ValidatorIdx int
+	Epoch        int
+
+	// Where the validator was supposed to attest: the slot, the committee,
+	// and its position in the committee (its bit in the aggregation bitfield)
+	Slot           int
+	CommitteeIndex int
+	Position       int
+
+	// Slot of the block that included its attestation first (-1 if missing)
+	InclusionSlot int
+
+	Distance          int
+	EffectiveDistance int
+	Flags             int
+}
+
+// Upsert a watchlist_duties row. Like for validator_state, another collector
+// may have seen more of the epoch: keep the first inclusion either of us saw,
+// the shortest distances and every flag.
+const registerWatchDutyQuery = `INSERT INTO watchlist_duties(validator_idx, epoch, slot, committee_index, position,
+		inclusion_slot, distance, effective_distance, flags) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (validator_idx, epoch) DO UPDATE SET slot = excluded.slot, committee_index = excluded.committee_index,
+		position = excluded.position,
+		inclusion_slot = CASE WHEN watchlist_duties.inclusion_slot = -1
+			OR (excluded.inclusion_slot != -1 AND excluded.inclusion_slot < watchlist_duties.inclusion_slot)
+			THEN excluded.inclusion_slot ELSE watchlist_duties.inclusion_slot END,
+		distance = CASE WHEN excluded.distance < watchlist_duties.distance THEN excluded.distance ELSE watchlist_duties.distance END,
+		effective_distance = CASE WHEN excluded.effective_distance < watchlist_duties.effective_distance
+			THEN excluded.effective_distance ELSE watchlist_duties.effective_distance END,
+		flags = watchlist_duties.flags | excluded.flags`
+
+// Register the duties of many watched validators at once
+func (db *Database) RegisterWatchlistDuties(rows []WatchDutyRow) error {
+	defer metrics.TimeDBWrite("register_watchlist_duties").ObserveDuration()
+
+	return db.writeRows("register watchlist duties", registerWatchDutyQuery, len(rows), func(i int) []interface{} {
+		row := &rows[i]
+		return []interface{}{row.ValidatorIdx, row.Epoch, row.Slot, row.CommitteeIndex, row.Position,
+			row.InclusionSlot, row.Distance, row.EffectiveDistance, row.Flags}
+	})
+}
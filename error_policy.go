@@ -0,0 +1,117 @@
+/// The policy layer that decides what to do when something goes wrong while
+/// collecting data: retry, skip the block/slot at hand, or abort the run.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/eth2_handler"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+type errorAction int
+
+const (
+	// Try the same thing again, after a short pause
+	actionRetry errorAction = iota
+	// Give up on the block/slot at hand and move on
+	actionSkip
+	// Stop the collection
+	actionAbort
+)
+
+// How long to wait before retrying when the node is unavailable
+const nodeRetryPause = 5 * time.Second
+
+// Is `err` telling us that there is no block at the slot we asked for?
+// (Anything else that's not found goes through the policy.)
+func is_empty_slot(err error) bool {
+	var blockNotFound *eth2_handler.BlockNotFoundError
+	return errors.As(err, &blockNotFound)
+}
+
+// Decide what to do about `err`
+func error_action(err error) errorAction {
+	var nodeUnavailable *eth2_handler.NodeUnavailableError
+	var notFound *eth2_handler.NotFoundError
+	var blockNotFound *eth2_handler.BlockNotFoundError
+	var invalidRequest *eth2_handler.InvalidRequestError
+	var decodeErr *eth2_handler.DecodeError
+	var unsupportedFork *eth2_handler.UnsupportedForkError
+	var unknownCommittee *trackers.UnknownCommitteeError
+	var unknownSyncCommittee *trackers.UnknownSyncCommitteeError
+	var storageErr *db.StorageError
+
+	switch {
+	case errors.As(err, &nodeUnavailable):
+		// The node will hopefully come back
+		return actionRetry
+	case errors.As(err, &notFound), errors.As(err, &blockNotFound):
+		// Empty slot, or something the node does not have: nothing to see here
+		return actionSkip
+	case errors.As(err, &invalidRequest):
+		// The node won't change its mind about serving this
+		return actionSkip
+	case errors.As(err, &unsupportedFork):
+		// Every block from now on will be of that fork
+		return actionAbort
+	case errors.As(err, &decodeErr):
+		// Asking again will get us the same garbage
+		return actionSkip
+	case errors.As(err, &unknownCommittee):
+		// The rest of the block was handled; only that attestation is lost
+		return actionSkip
+	case errors.As(err, &unknownSyncCommittee):
+		// Asking again will get us the same committees
+		return actionSkip
+	case errors.As(err, &storageErr):
+		// We can't keep our data anywhere. Stop before we collect more.
+		return actionAbort
+	default:
+		return actionAbort
+	}
+}
+
+// Apply the policy on `err`, which happened while working on `slot`, and
+// return the action the caller should take. Never returns on actionAbort.
+func (m *Visit) handle_error(err error, slot common.Slot) errorAction {
+	action := error_action(err)
+	switch action {
+	case actionRetry:
+		fmt.Printf("[!] Error on slot #%d: %v. Retrying in %s...\n", slot, err, nodeRetryPause)
+		metrics.FetchRetries.Inc()
+		time.Sleep(nodeRetryPause)
+	case actionSkip:
+		fmt.Printf("[!] Error on slot #%d: %v. Skipping...\n", slot, err)
+		metrics.SkippedSlots.WithLabelValues("error").Inc()
+	case actionAbort:
+		m.abort(err)
+	}
+	return action
+}
+
+// Stop the collection because of `err`, saving what we can
+func (m *Visit) abort(err error) {
+	fmt.Printf("[!] Fatal error: %v. Aborting...\n", err)
+
+	// Try to keep the data we collected so far, unless it's the storage
+	// that's broken
+	var storageErr *db.StorageError
+	if !errors.As(err, &storageErr) {
+		if cpErr := trackers.SaveCheckpoint(m.eth2Handler.CommitteeTracker()); cpErr != nil {
+			fmt.Printf("[!] Failed to save checkpoint: %v\n", cpErr)
+		}
+		if dumpErr := trackers.DumpActivityTracker(); dumpErr != nil {
+			fmt.Printf("[!] Failed to dump the data: %v\n", dumpErr)
+		}
+	}
+	m.database.Close()
+	os.Exit(1)
+}
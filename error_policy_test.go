@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/eth2_handler"
+)
+
+func TestErrorAction(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		action errorAction
+	}{
+		{&eth2_handler.NodeUnavailableError{What: "block 5"}, actionRetry},
+		{&eth2_handler.BlockNotFoundError{What: "block 5"}, actionSkip},
+		{&eth2_handler.NotFoundError{What: "committees"}, actionSkip},
+		{&eth2_handler.InvalidRequestError{What: "committees"}, actionSkip},
+		{&eth2_handler.DecodeError{What: "block 5"}, actionSkip},
+		{fmt.Errorf("processing: %w", &eth2_handler.UnsupportedForkError{What: "block 5", Fork: "electra"}), actionAbort},
+		{&db.StorageError{Op: "register", Err: errors.New("disk full")}, actionAbort},
+		{errors.New("something else"), actionAbort},
+	} {
+		if action := error_action(test.err); action != test.action {
+			t.Errorf("%v: got action %d, expected %d", test.err, action, test.action)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/// This module takes care of decoding blocks of every fork. Blocks are versioned
+/// by fork name in the API (/eth/v2/beacon/blocks), and their bodies grow new
+/// fields with every fork. The parts of the body that visit looks at have kept
+/// the same shape from phase0 to deneb, so we decode just those into a
+/// fork-agnostic Block instead of the full fork-specific block. Later forks
+/// changed the shape of attestations: we refuse to go on with their blocks
+/// rather than getting them wrong.
+
+package eth2_handler
+
+import (
+	"encoding/json"
+
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// The forks we know how to decode blocks for (in order)
+const (
+	ForkPhase0    = "phase0"
+	ForkAltair    = "altair"
+	ForkBellatrix = "bellatrix"
+	ForkCapella   = "capella"
+	ForkDeneb     = "deneb"
+)
+
+var knownForks = map[string]bool{
+	ForkPhase0:    true,
+	ForkAltair:    true,
+	ForkBellatrix: true,
+	ForkCapella:   true,
+	ForkDeneb:     true,
+}
+
+// Forks whose blocks we can't decode: electra reshaped attestations (one
+// aggregate spans several committees)
+const (
+	ForkElectra = "electra"
+	ForkFulu    = "fulu"
+)
+
+// A decoded block, whatever its fork
+type Block struct {
+	// Name of the fork the block belongs to
+	Fork string
+
+	// Root of the block (filled in by the caller of fetchBlock(), since we
+	// don't decode enough of the block to compute it)
+	Root common.Root
+
+	Slot          common.Slot
+	ProposerIndex common.ValidatorIndex
+	ParentRoot    common.Root
+	StateRoot     common.Root
+
+	Attestations []phase0.Attestation
+
+	// nil before altair
+	SyncAggregate *altair.SyncAggregate
+
+	// Operations that change the lifecycle of validators
+	Deposits          []common.Deposit
+	VoluntaryExits    []phase0.SignedVoluntaryExit
+	ProposerSlashings []phase0.ProposerSlashing
+	AttesterSlashings []phase0.AttesterSlashing
+}
+
+// Wire format of a /eth/v2/beacon/blocks response. We only decode the block
+// once we know it's of a fork we support.
+type blockResponse struct {
+	Version string          `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// The block of a blockResponse, reduced to what we need
+type blockData struct {
+	Message struct {
+		Slot          common.Slot           `json:"slot"`
+		ProposerIndex common.ValidatorIndex `json:"proposer_index"`
+		ParentRoot    common.Root           `json:"parent_root"`
+		StateRoot     common.Root           `json:"state_root"`
+		Body          struct {
+			Attestations      []phase0.Attestation         `json:"attestations"`
+			SyncAggregate     *altair.SyncAggregate        `json:"sync_aggregate"`
+			Deposits          []common.Deposit             `json:"deposits"`
+			VoluntaryExits    []phase0.SignedVoluntaryExit `json:"voluntary_exits"`
+			ProposerSlashings []phase0.ProposerSlashing    `json:"proposer_slashings"`
+			AttesterSlashings []phase0.AttesterSlashing    `json:"attester_slashings"`
+		} `json:"body"`
+	} `json:"message"`
+}
+
+// Figure out the fork of `slot` from the fork epochs of the spec. Only used
+// when the node does not tell us the version of a block.
+func (h *Eth2Handler) forkAtSlot(slot common.Slot) string {
+	epoch := trackers.ComputeEpochAtSlot(slot)
+	switch {
+	case epoch >= h.forks.Fulu:
+		return ForkFulu
+	case epoch >= h.forks.Electra:
+		return ForkElectra
+	case epoch >= h.forks.Deneb:
+		return ForkDeneb
+	case epoch >= h.forks.Capella:
+		return ForkCapella
+	case epoch >= h.forks.Bellatrix || epoch >= h.spec.MERGE_FORK_EPOCH:
+		return ForkBellatrix
+	case epoch >= h.spec.ALTAIR_FORK_EPOCH:
+		return ForkAltair
+	}
+	return ForkPhase0
+}
+
+// Fetch the block identified by `blockId` and decode it according to its fork
+func (h *Eth2Handler) fetchBlock(blockId eth2api.BlockId) (*Block, error) {
+	what := "block " + blockId.BlockId()
+
+	var resp blockResponse
+	timer := metrics.TimeAPIRequest("block")
+	exists, err := eth2api.SimpleRequest(h.ctx, h.client,
+		eth2api.FmtGET("/eth/v2/beacon/blocks/%s", blockId.BlockId()), &resp)
+	timer.ObserveDuration()
+	if err := apiError(what, exists, err); err != nil {
+		return nil, err
+	}
+
+	fork := resp.Version
+	if fork != "" && !knownForks[fork] {
+		return nil, &UnsupportedForkError{What: what, Fork: fork}
+	}
+
+	var data blockData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, &DecodeError{What: what, Err: err}
+	}
+	msg := data.Message
+
+	if fork == "" {
+		fork = h.forkAtSlot(msg.Slot)
+		if !knownForks[fork] {
+			return nil, &UnsupportedForkError{What: what, Fork: fork}
+		}
+	}
+
+	return &Block{
+		Fork:              fork,
+		Slot:              msg.Slot,
+		ProposerIndex:     msg.ProposerIndex,
+		ParentRoot:        msg.ParentRoot,
+		StateRoot:         msg.StateRoot,
+		Attestations:      msg.Body.Attestations,
+		SyncAggregate:     msg.Body.SyncAggregate,
+		Deposits:          msg.Body.Deposits,
+		VoluntaryExits:    msg.Body.VoluntaryExits,
+		ProposerSlashings: msg.Body.ProposerSlashings,
+		AttesterSlashings: msg.Body.AttesterSlashings,
+	}, nil
+}
@@ -0,0 +1,113 @@
+package eth2_handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/configs"
+)
+
+func TestForkAtSlot(t *testing.T) {
+	spec := *configs.Mainnet
+	forks := farFutureForks()
+	specYaml := "ALTAIR_FORK_EPOCH: 10\nBELLATRIX_FORK_EPOCH: 20\nCAPELLA_FORK_EPOCH: 30\nDENEB_FORK_EPOCH: 40\n" +
+		"ELECTRA_FORK_EPOCH: 50\nFULU_FORK_EPOCH: 60\n"
+	if err := applySpecYaml(&spec, &forks, []byte(specYaml)); err != nil {
+		t.Fatal(err)
+	}
+	h := &Eth2Handler{spec: &spec, forks: forks}
+
+	for _, test := range []struct {
+		epoch common.Epoch
+		fork  string
+	}{
+		{0, ForkPhase0},
+		{9, ForkPhase0},
+		{10, ForkAltair},
+		{20, ForkBellatrix},
+		{29, ForkBellatrix},
+		{30, ForkCapella},
+		{40, ForkDeneb},
+		{49, ForkDeneb},
+		{50, ForkElectra},
+		{60, ForkFulu},
+		{1000000, ForkFulu},
+	} {
+		slot := common.Slot(test.epoch)*spec.SLOTS_PER_EPOCH + 1
+		if fork := h.forkAtSlot(slot); fork != test.fork {
+			t.Errorf("epoch #%d: got %s, expected %s", test.epoch, fork, test.fork)
+		}
+	}
+}
+
+func TestForkAtSlotOldMergeName(t *testing.T) {
+	spec := *configs.Mainnet
+	forks := farFutureForks()
+	if err := applySpecYaml(&spec, &forks, []byte("ALTAIR_FORK_EPOCH: 1\nMERGE_FORK_EPOCH: 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	h := &Eth2Handler{spec: &spec, forks: forks}
+
+	if fork := h.forkAtSlot(2 * spec.SLOTS_PER_EPOCH); fork != ForkBellatrix {
+		t.Errorf("got %s, expected %s", fork, ForkBellatrix)
+	}
+	if fork := h.forkAtSlot(spec.SLOTS_PER_EPOCH); fork != ForkAltair {
+		t.Errorf("got %s, expected %s", fork, ForkAltair)
+	}
+}
+
+// A node that serves the block of every slot as a block of `version`, with
+// the body of the blocks of the forks before electra
+func testBlockHandler(t *testing.T, version string) *Eth2Handler {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var slot int
+		if _, err := fmt.Sscanf(r.URL.Path, "/eth/v2/beacon/blocks/%d", &slot); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"version": %q, "data": {"message": {"slot": "%d", "proposer_index": "7", "body": {"attestations": []}}}}`,
+			version, slot)
+	}))
+	t.Cleanup(srv.Close)
+
+	spec := *configs.Mainnet
+	forks := farFutureForks()
+	forks.Electra = 10
+	h := testHandler(srv.URL)
+	h.spec, h.forks = &spec, forks
+	return h
+}
+
+func TestFetchBlockForks(t *testing.T) {
+	block, err := testBlockHandler(t, ForkDeneb).fetchBlock(eth2api.BlockIdSlot(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Fork != ForkDeneb || block.Slot != 5 || block.ProposerIndex != 7 {
+		t.Errorf("wrong block: %+v", block)
+	}
+
+	// Without a version, the spec tells
+	h := testBlockHandler(t, "")
+	if block, err := h.fetchBlock(eth2api.BlockIdSlot(5)); err != nil || block.Fork != ForkPhase0 {
+		t.Errorf("got %+v (%v), expected a phase0 block", block, err)
+	}
+
+	for _, test := range []struct {
+		version string
+		slot    common.Slot
+	}{
+		{ForkElectra, 5},
+		{ForkFulu, 5},
+		{"", 10 * 32},
+	} {
+		_, err := testBlockHandler(t, test.version).fetchBlock(eth2api.BlockIdSlot(test.slot))
+		if _, ok := err.(*UnsupportedForkError); !ok {
+			t.Errorf("%q block of slot #%d: expected an UnsupportedForkError, got %v", test.version, test.slot, err)
+		}
+	}
+}
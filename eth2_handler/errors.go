@@ -0,0 +1,153 @@
+/// Errors that can happen while talking to the beacon node. They are typed so
+/// that the caller can decide whether to retry, skip or give up.
+
+package eth2_handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/protolambda/eth2api"
+)
+
+// The node could not be reached, or is not able to serve us right now (e.g.
+// it's syncing or having internal trouble)
+type NodeUnavailableError struct {
+	What string
+	Err  error
+}
+
+func (e *NodeUnavailableError) Error() string {
+	return fmt.Sprintf("node unavailable while fetching %s: %v", e.What, e.Err)
+}
+
+func (e *NodeUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// The node does not have what we asked for (e.g. a block of an empty slot, or
+// a block that has not arrived yet)
+type NotFoundError struct {
+	What string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s not found", e.What)
+}
+
+// The block we were asked to fetch is not there: for a slot, that means the
+// slot is empty, or that its block has not arrived yet. Whatever else we fetch
+// along with the block is a plain NotFoundError when it's missing.
+type BlockNotFoundError struct {
+	What string
+}
+
+func (e *BlockNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found", e.What)
+}
+
+// The node refused our request (a 4xx response other than 404), e.g. because
+// it pruned the state we asked about
+type InvalidRequestError struct {
+	What string
+	Err  error
+}
+
+func (e *InvalidRequestError) Error() string {
+	return fmt.Sprintf("node refused request for %s: %v", e.What, e.Err)
+}
+
+func (e *InvalidRequestError) Unwrap() error {
+	return e.Err
+}
+
+// The block is of a fork that we can't decode the blocks of. Every block after
+// it will be too, so there is no point in going on.
+type UnsupportedForkError struct {
+	What string
+	Fork string
+}
+
+func (e *UnsupportedForkError) Error() string {
+	return fmt.Sprintf("unsupported fork %q of %s: visit can't decode its blocks", e.Fork, e.What)
+}
+
+// The node answered but we could not make sense of the answer
+type DecodeError struct {
+	What string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %s: %v", e.What, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// An error response whose body we could not decode (e.g. the HTML page of a
+// proxy in front of the node)
+type statusError struct {
+	Code uint
+	Err  error
+}
+
+func (e *statusError) Error() string {
+	return e.Err.Error() // already mentions the status code
+}
+
+func (e *statusError) Unwrap() error {
+	return e.Err
+}
+
+// The JSON codec of eth2api, except that it keeps the status code of the error
+// responses it can't decode
+type statusCodec struct {
+	eth2api.JSONCodec
+}
+
+func (c statusCodec) DecodeResponseBody(code uint, r io.ReadCloser, dest interface{}) error {
+	err := c.JSONCodec.DecodeResponseBody(code, r, dest)
+	if _, ok := err.(eth2api.ClientApiErr); ok {
+		return &statusError{Code: code, Err: err}
+	}
+	return err
+}
+
+// Turn the result of an eth2api request for `what` into one of our typed
+// errors (or nil if the request went fine)
+func apiError(what string, exists bool, err error) error {
+	if !exists {
+		return &NotFoundError{What: what}
+	}
+	if err == nil {
+		return nil
+	}
+
+	var urlErr *url.Error
+	var internalErr *eth2api.InternalError
+	var syncingErr *eth2api.CurrentlySyncing
+	var otherErr *eth2api.ErrorResponse // status codes of 600 and up
+	if errors.As(err, &urlErr) || errors.As(err, &internalErr) || errors.As(err, &syncingErr) ||
+		errors.As(err, &otherErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &NodeUnavailableError{What: what, Err: err}
+	}
+
+	var invalidErr *eth2api.InvalidRequest
+	if errors.As(err, &invalidErr) {
+		return &InvalidRequestError{What: what, Err: err}
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Code >= 500 {
+			return &NodeUnavailableError{What: what, Err: err}
+		}
+		return &InvalidRequestError{What: what, Err: err}
+	}
+
+	return &DecodeError{What: what, Err: err}
+}
@@ -0,0 +1,76 @@
+package eth2_handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+func TestApiError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var code int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/"), "%d", &code)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/json"):
+			w.WriteHeader(code)
+			fmt.Fprintf(w, `{"code": %d, "message": "something"}`, code)
+		case strings.HasSuffix(r.URL.Path, "/html"):
+			w.WriteHeader(code)
+			fmt.Fprint(w, "<html><body>Bad Gateway</body></html>")
+		case strings.HasSuffix(r.URL.Path, "/truncated"):
+			fmt.Fprint(w, `{"data": {"slot": "1`)
+		case strings.HasSuffix(r.URL.Path, "/garbage"):
+			fmt.Fprint(w, `{"data": {"slot": true}}`)
+		default:
+			fmt.Fprint(w, `{"data": {"slot": "1"}}`)
+		}
+	}))
+	h := testHandler(srv.URL)
+
+	request := func(path string) error {
+		var dest struct {
+			Slot common.Slot `json:"slot"`
+		}
+		exists, err := eth2api.SimpleRequest(h.ctx, h.client, eth2api.FmtGET("%s", path), eth2api.Wrap(&dest))
+		return apiError(path, exists, err)
+	}
+
+	var nodeUnavailable *NodeUnavailableError
+	var notFound *NotFoundError
+	var invalidRequest *InvalidRequestError
+	var decodeErr *DecodeError
+	for _, test := range []struct {
+		path   string
+		target interface{}
+	}{
+		{"/500/json", &nodeUnavailable},
+		{"/503/json", &nodeUnavailable},
+		{"/502/html", &nodeUnavailable},
+		{"/504/html", &nodeUnavailable},
+		{"/200/truncated", &nodeUnavailable},
+		{"/404/json", &notFound},
+		{"/404/html", &notFound},
+		{"/400/json", &invalidRequest},
+		{"/403/html", &invalidRequest},
+		{"/200/garbage", &decodeErr},
+	} {
+		if err := request(test.path); err == nil || !errors.As(err, test.target) {
+			t.Errorf("%s: got %T (%v), expected %T", test.path, err, err, test.target)
+		}
+	}
+
+	if err := request("/200/ok"); err != nil {
+		t.Errorf("got %v for a good response", err)
+	}
+
+	srv.Close()
+	if err := request("/200/ok"); !errors.As(err, &nodeUnavailable) {
+		t.Errorf("got %T (%v) for a node that's gone, expected %T", err, err, nodeUnavailable)
+	}
+}
@@ -6,50 +6,70 @@ package eth2_handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/asn-d6/visit/config"
+	"github.com/asn-d6/visit/metrics"
 	"github.com/asn-d6/visit/trackers"
 
 	"github.com/protolambda/eth2api"
 	"github.com/protolambda/eth2api/client/beaconapi"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
-	"github.com/protolambda/zrnt/eth2/configs"
 
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 )
 
 type Eth2Handler struct {
 	// Various information for eth2api to function
-	client     *eth2api.Eth2HttpClient
-	ctx        context.Context
-	genesis    eth2api.GenesisResponse
-	forkDigest common.ForkDigest
-	spec       *common.Spec
+	client  *eth2api.Eth2HttpClient
+	ctx     context.Context
+	genesis eth2api.GenesisResponse
+	spec    *common.Spec
+
+	// Epochs of the forks that the spec doesn't hold
+	forks forkEpochs
+
+	// When each slot starts, according to the genesis time and the spec
+	clock *SlotClock
 
 	// Our trusted committee tracker. Keeps track of committees so that we can
 	// correlate them with attestations when needed
 	committeeTracker *trackers.CommitteeTracker
+
+	// Same for sync committees and sync aggregates
+	syncCommitteeTracker *trackers.SyncCommitteeTracker
+
+	// Roots of the canonical blocks of recent slots, to check votes against
+	blockRoots map[common.Slot]common.Root
+
+	// Epochs we have fetched the proposer duties of
+	proposerDutiesFetched map[common.Epoch]bool
+
+	// The balances at the end of the last epoch we got the rewards of, which
+	// are the balances at the start of the next one
+	lastBalancesSlot common.Slot
+	lastBalances     map[common.ValidatorIndex]common.Gwei
 }
 
 const (
 	blockHead = eth2api.BlockHead
-	stateHead = eth2api.StateHead
 )
 
-func InitEth2Handler() *Eth2Handler {
+func InitEth2Handler(cfg *config.Config) *Eth2Handler {
 	// Make an HTTP client (reuse connections!)
 	client := &eth2api.Eth2HttpClient{
-		Addr: "http://" + os.Args[1],
+		Addr: "http://" + cfg.BeaconAddr,
 		Cli: &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConnsPerHost: 123,
 			},
 			Timeout: 40 * time.Second,
 		},
-		Codec: eth2api.JSONCodec{},
+		Codec: statusCodec{},
 	}
 
 	//// e.g. cancel requests with a context.WithTimeout/WithCancel/WithDeadline
@@ -64,105 +84,190 @@ func InitEth2Handler() *Eth2Handler {
 		os.Exit(1)
 	}
 
-	spec := configs.Mainnet
-	// or load testnet config info from a YAML file
-	// yaml.Unmarshal(data, &spec.Config)
-
-	// every fork has a digest. Blocks are versioned by name in the API,
-	// but wrapped with digest info in ZRNT to do enable different kinds of processing
-	forkDigest := common.ComputeForkDigest(spec.ALTAIR_FORK_VERSION, genesis.GenesisValidatorsRoot)
+	h := &Eth2Handler{
+		client:                client,
+		ctx:                   ctx,
+		genesis:               genesis,
+		committeeTracker:      trackers.InitCommitteeTracker(),
+		syncCommitteeTracker:  trackers.InitSyncCommitteeTracker(),
+		blockRoots:            make(map[common.Slot]common.Root),
+		proposerDutiesFetched: make(map[common.Epoch]bool),
+	}
 
-	return &Eth2Handler{
-		client:           client,
-		ctx:              ctx,
-		genesis:          genesis,
-		forkDigest:       forkDigest,
-		spec:             spec,
-		committeeTracker: trackers.InitCommitteeTracker(),
+	spec, forks, err := h.loadSpec(cfg)
+	if err != nil {
+		fmt.Println("failed to load spec", err)
+		os.Exit(1)
 	}
+	fmt.Printf("[!] Using %s spec (%d slots per epoch, %d seconds per slot)\n",
+		spec.PRESET_BASE, spec.SLOTS_PER_EPOCH, spec.SECONDS_PER_SLOT)
+
+	// The slot/epoch helpers of the trackers need to know the epoch length
+	trackers.InitSpec(spec)
+
+	h.spec = spec
+	h.forks = forks
+	h.clock = InitSlotClock(genesis.GenesisTime, spec.SECONDS_PER_SLOT)
+	return h
 }
 
-func getAttestationsFromBlock(signedBlock phase0.SignedBeaconBlock) []phase0.Attestation {
-	return signedBlock.Message.Body.Attestations
+func (h *Eth2Handler) SlotClock() *SlotClock {
+	return h.clock
 }
 
-// Make sure we know all committees referenced by these attestations
-func (h *Eth2Handler) FetchCommitteeInfoIfNeeded(attestations []phase0.Attestation) {
+func (h *Eth2Handler) CommitteeTracker() *trackers.CommitteeTracker {
+	return h.committeeTracker
+}
+
+// Make sure we know all committees referenced by these attestations (found in
+// the block of `blockSlot`)
+func (h *Eth2Handler) FetchCommitteeInfoIfNeeded(attestations []phase0.Attestation, blockSlot common.Slot) error {
 	for _, att := range attestations {
 		if !h.committeeTracker.CommitteesAreKnownForSlot(att.Data.Slot) {
-			// Fetch committees for the entire current epoch
+			// Fetch committees for the entire epoch of the attestation. We
+			// resolve them against the state of the block that included the
+			// attestation (and not the head state), so that this also works
+			// when we are looking at old blocks.
+			epoch := trackers.ComputeEpochAtSlot(att.Data.Slot)
 			fmt.Printf("[!] Fetched block with attestations for slot #%d but we don't have"+
-				" committee info for it. Fetching...\n", att.Data.Slot)
-			h.getCommittees(nil, nil)
-
-			// If the above committee fetch was not sufficient (e.g. because
-			// the attestation was refering to a previous epoch), fetch the
-			// specific slot committee
-			if !h.committeeTracker.CommitteesAreKnownForSlot(att.Data.Slot) {
-				fmt.Printf("[!] Fetching committees specifically for that slot...\n")
-				epoch := trackers.ComputeEpochAtSlot(att.Data.Slot)
-				h.getCommittees(&att.Data.Slot, &epoch)
+				" committee info for it. Fetching committees of epoch #%d...\n", att.Data.Slot, epoch)
+			if err := h.getCommittees(blockSlot, epoch); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
 // Attempt to fetch and process attestations of the block at `blockNumber` (get 'head' if it's zero)
 //
-// If the block was fetched and handled, return its block number, else return 0.
-func (h *Eth2Handler) FetchAndProcessBlock(blockNumber int) int {
-	var signedBlock phase0.SignedBeaconBlock
-	var exists bool
-	var err error
-
+// If the block was fetched and handled, return its block number. Otherwise
+// return one of the typed errors of this module (or of the trackers): a
+// BlockNotFoundError if there is no block at `blockNumber`.
+func (h *Eth2Handler) FetchAndProcessBlock(blockNumber int) (int, error) {
 	if blockNumber != 0 {
 		fmt.Printf("[*] Attempting to fetch block for slot #%d\n", blockNumber)
-		exists, err = beaconapi.Block(h.ctx, h.client, eth2api.BlockIdSlot(common.Slot(blockNumber)), &signedBlock)
-	} else {
-		fmt.Printf("[*] Attempting to fetch the latest block\n")
-		exists, err = beaconapi.Block(h.ctx, h.client, blockHead, &signedBlock)
+		return h.fetchAndProcessBlock(eth2api.BlockIdSlot(common.Slot(blockNumber)))
+	}
+
+	fmt.Printf("[*] Attempting to fetch the latest block\n")
+	return h.fetchAndProcessBlock(blockHead)
+}
+
+// Attempt to fetch and process attestations of the block with root `root`
+//
+// Same return values as FetchAndProcessBlock().
+func (h *Eth2Handler) FetchAndProcessBlockByRoot(root common.Root) (int, error) {
+	fmt.Printf("[*] Attempting to fetch block %s\n", root)
+	return h.fetchAndProcessBlock(eth2api.BlockIdRoot(root))
+}
+
+func (h *Eth2Handler) fetchAndProcessBlock(blockId eth2api.BlockId) (int, error) {
+	block, err := h.fetchBlock(blockId)
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return 0, &BlockNotFoundError{What: notFound.What}
+	} else if err != nil {
+		return 0, err
 	}
+	metrics.BlocksFetched.Inc()
 
-	if !exists { // block not here yet. it's ok we will retry
-		return 0
+	block.Root, err = h.blockRootOf(blockId, block)
+	if err != nil {
+		return 0, err
+	}
+	if _, seen := trackers.JournaledBlock(block.Root); seen {
+		fmt.Printf("[*] Block %s of slot #%d was already processed\n", block.Root, block.Slot)
+		return int(block.Slot), nil
 	}
 
-	if err != nil { // unrecoverable error. time to panic hard.
-		panic(err)
+	if err := h.followChain(block); err != nil {
+		return 0, err
+	}
+	if err := h.processBlock(block); err != nil {
+		return 0, err
 	}
+	return int(block.Slot), nil
+}
 
-	// Add metadata to signed block so that we can access its fields
-	attestations := getAttestationsFromBlock(signedBlock)
+// Handle a fetched `block` (whose root we know) and pass it to the trackers
+func (h *Eth2Handler) processBlock(block *Block) error {
+	attestations := block.Attestations
 
-	h.FetchCommitteeInfoIfNeeded(attestations)
+	if err := h.FetchCommitteeInfoIfNeeded(attestations, block.Slot); err != nil {
+		return err
+	}
 
-	epoch := trackers.ComputeEpochAtSlot(signedBlock.Message.Slot)
-	fmt.Printf("[*] Fetched block for slot #%d (slot %d of epoch #%d) (#%d attestations)\n", signedBlock.Message.Slot,
-		trackers.ComputeSlotIndexWithinEpoch(signedBlock.Message.Slot), epoch, len(attestations))
+	epoch := trackers.ComputeEpochAtSlot(block.Slot)
+	fmt.Printf("[*] Fetched %s block for slot #%d (slot %d of epoch #%d) (#%d attestations)\n", block.Fork, block.Slot,
+		trackers.ComputeSlotIndexWithinEpoch(block.Slot), epoch, len(attestations))
 
-	h.committeeTracker.HandleAttestations(attestations, signedBlock.Message.Slot)
+	if block.SyncAggregate != nil {
+		if err := h.fetchSyncCommitteeIfNeeded(block.Slot); err != nil {
+			return err
+		}
+	}
+
+	flags, err := h.participationFlags(block)
+	if err != nil {
+		return err
+	}
 
-	return int(signedBlock.Message.Slot)
+	h.fetchProposerDutiesIfNeeded(epoch)
+	trackers.RegisterBlockProposal(block.Slot, block.ProposerIndex, block.Root, block.ParentRoot)
+	trackers.RegisterLifecycleEvents(block.Slot, lifecycleEvents(block))
+
+	// A sync aggregate we can't handle doesn't make the attestations of the
+	// block any less useful: handle them anyway, and return the first error
+	var firstErr error
+	if block.SyncAggregate != nil {
+		firstErr = h.syncCommitteeTracker.HandleSyncAggregate(block.Slot, block.SyncAggregate.SyncCommitteeBits)
+	}
+	if err := h.committeeTracker.HandleAttestations(attestations, flags, block.Slot); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
 }
 
-// Get the latest committee information and register them on the commitee tracker
-//
-// If `slot` and `epoch` are set, fetch that specific committee
-func (h *Eth2Handler) getCommittees(slot *common.Slot, epoch *common.Epoch) {
+// Make sure we know the sync committee in charge at the block of `blockSlot`
+func (h *Eth2Handler) fetchSyncCommitteeIfNeeded(blockSlot common.Slot) error {
+	epoch := trackers.ComputeEpochAtSlot(blockSlot)
+	if h.syncCommitteeTracker.SyncCommitteeIsKnownForEpoch(epoch) {
+		return nil
+	}
+
+	var committee eth2api.SyncCommittees
+	timer := metrics.TimeAPIRequest("sync_committees")
+	exists, err := beaconapi.SyncCommittees(h.ctx, h.client, eth2api.StateIdSlot(blockSlot), &epoch, &committee)
+	timer.ObserveDuration()
+
+	what := fmt.Sprintf("sync committee of epoch #%d", epoch)
+	if err := apiError(what, exists, err); err != nil {
+		return err
+	}
+
+	h.syncCommitteeTracker.RegisterSyncCommittee(trackers.ComputeSyncCommitteePeriod(epoch), committee.Validators)
+	return nil
+}
+
+// Get the committee information of `epoch`, as seen by the state at
+// `stateSlot`, and register them on the commitee tracker
+func (h *Eth2Handler) getCommittees(stateSlot common.Slot, epoch common.Epoch) error {
 	var committees []eth2api.Committee
+	timer := metrics.TimeAPIRequest("committees")
 	exists, err := beaconapi.EpochCommittees(h.ctx, h.client,
-		stateHead,
-		epoch, // epoch
-		nil,   // committee index
-		slot,  // slot
+		eth2api.StateIdSlot(stateSlot),
+		&epoch, // epoch
+		nil,    // committee index
+		nil,    // slot
 		&committees)
+	timer.ObserveDuration()
 
-	// Handle errors
-	if !exists {
-		panic("commitee not found")
-	} else if err != nil {
-		panic(err)
+	what := fmt.Sprintf("committees of epoch #%d", epoch)
+	if err := apiError(what, exists, err); err != nil {
+		return err
 	}
 
 	h.committeeTracker.RegisterCommittees(committees)
+	return nil
 }
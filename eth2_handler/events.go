@@ -0,0 +1,176 @@
+/// This module subscribes to the server-sent event stream of the beacon node
+/// (/eth/v1/events), so that we learn about new blocks as soon as the node
+/// imports them instead of polling for every slot.
+
+package eth2_handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// The topics we subscribe to
+const (
+	TopicHead                = "head"
+	TopicBlock               = "block"
+	TopicChainReorg          = "chain_reorg"
+	TopicFinalizedCheckpoint = "finalized_checkpoint"
+)
+
+var eventTopics = []string{TopicHead, TopicBlock, TopicChainReorg, TopicFinalizedCheckpoint}
+
+// A raw event, as read from the stream
+type Event struct {
+	Topic string
+	Data  []byte
+}
+
+type HeadEvent struct {
+	Slot                      common.Slot `json:"slot"`
+	Block                     common.Root `json:"block"`
+	State                     common.Root `json:"state"`
+	EpochTransition           bool        `json:"epoch_transition"`
+	PreviousDutyDependentRoot common.Root `json:"previous_duty_dependent_root"`
+	CurrentDutyDependentRoot  common.Root `json:"current_duty_dependent_root"`
+}
+
+type BlockEvent struct {
+	Slot  common.Slot `json:"slot"`
+	Block common.Root `json:"block"`
+}
+
+type ChainReorgEvent struct {
+	Slot         common.Slot  `json:"slot"`
+	Depth        common.Slot  `json:"depth"`
+	OldHeadBlock common.Root  `json:"old_head_block"`
+	NewHeadBlock common.Root  `json:"new_head_block"`
+	OldHeadState common.Root  `json:"old_head_state"`
+	NewHeadState common.Root  `json:"new_head_state"`
+	Epoch        common.Epoch `json:"epoch"`
+}
+
+type FinalizedCheckpointEvent struct {
+	Block common.Root  `json:"block"`
+	State common.Root  `json:"state"`
+	Epoch common.Epoch `json:"epoch"`
+}
+
+// Decode the payload of `ev` into the struct matching its topic (a
+// *HeadEvent, *BlockEvent, *ChainReorgEvent or *FinalizedCheckpointEvent)
+func (ev *Event) Decode() (interface{}, error) {
+	var dest interface{}
+	switch ev.Topic {
+	case TopicHead:
+		dest = new(HeadEvent)
+	case TopicBlock:
+		dest = new(BlockEvent)
+	case TopicChainReorg:
+		dest = new(ChainReorgEvent)
+	case TopicFinalizedCheckpoint:
+		dest = new(FinalizedCheckpointEvent)
+	default:
+		return nil, fmt.Errorf("unknown event topic %q", ev.Topic)
+	}
+
+	if err := json.Unmarshal(ev.Data, dest); err != nil {
+		return nil, fmt.Errorf("failed to decode %s event: %w", ev.Topic, err)
+	}
+	return dest, nil
+}
+
+// Read server-sent events from `r` and pass them to `events` until the stream
+// ends or `ctx` is cancelled. Always returns a non-nil error explaining why we
+// stopped.
+func ReadEvents(ctx context.Context, r io.Reader, events chan<- Event) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var topic string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" { // an empty line dispatches the event
+			if data.Len() > 0 {
+				ev := Event{Topic: topic, Data: append([]byte(nil), data.Bytes()...)}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			topic = ""
+			data.Reset()
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") { // comment (used as keep-alive)
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			topic = value
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream closed")
+}
+
+// Subscribe to the event stream of the beacon node. Events are delivered on
+// the returned channel. When the stream drops, the reason is sent on the
+// error channel and no more events will be delivered.
+func (h *Eth2Handler) SubscribeEvents(ctx context.Context) (<-chan Event, <-chan error) {
+	events := make(chan Event, 64)
+	errs := make(chan error, 1)
+
+	go func() {
+		url := h.client.Addr + "/eth/v1/events?topics=" + strings.Join(eventTopics, ",")
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			errs <- err
+			return
+		}
+		req.Header.Set("Accept", "text/event-stream")
+
+		// Don't use the eth2api HTTP client here: its timeout would cut the
+		// stream short
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errs <- fmt.Errorf("event stream subscription failed: %s", resp.Status)
+			return
+		}
+
+		fmt.Printf("[!] Subscribed to the event stream (%s)\n", strings.Join(eventTopics, ", "))
+		errs <- ReadEvents(ctx, resp.Body, events)
+	}()
+
+	return events, errs
+}
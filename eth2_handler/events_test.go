@@ -0,0 +1,170 @@
+package eth2_handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protolambda/eth2api"
+)
+
+const (
+	testRootA = "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testRootB = "0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// A stream with a keep-alive, a multi-line payload, a field we don't know and
+// an event without data
+var testStream = ": keep-alive\n" +
+	"event: block\n" +
+	"data: {\"slot\":\"10\",\"block\":\"" + testRootA + "\"}\n" +
+	"\n" +
+	"event: chain_reorg\n" +
+	"id: 7\n" +
+	"data: {\"slot\":\"11\",\"depth\":\"2\",\n" +
+	"data: \"old_head_block\":\"" + testRootA + "\",\"new_head_block\":\"" + testRootB + "\"}\n" +
+	"\n" +
+	"event: head\n" +
+	"\n" +
+	"event: finalized_checkpoint\n" +
+	"data:{\"epoch\":\"3\",\"block\":\"" + testRootB + "\"}\n" +
+	"\n"
+
+func checkTestStreamEvents(t *testing.T, events []Event) {
+	if len(events) != 3 {
+		t.Fatalf("got %d events, expected 3: %v", len(events), events)
+	}
+	for i, topic := range []string{TopicBlock, TopicChainReorg, TopicFinalizedCheckpoint} {
+		if events[i].Topic != topic {
+			t.Errorf("event %d has topic %q, expected %q", i, events[i].Topic, topic)
+		}
+	}
+
+	payload, err := events[1].Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reorg, ok := payload.(*ChainReorgEvent)
+	if !ok {
+		t.Fatalf("chain_reorg decoded into %T", payload)
+	}
+	if reorg.Slot != 11 || reorg.Depth != 2 || reorg.NewHeadBlock.String() != testRootB {
+		t.Errorf("wrong chain_reorg event: %+v", reorg)
+	}
+
+	payload, err = events[2].Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finalized := payload.(*FinalizedCheckpointEvent); finalized.Epoch != 3 {
+		t.Errorf("wrong finalized_checkpoint event: %+v", finalized)
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	err := ReadEvents(context.Background(), strings.NewReader(testStream), events)
+	if err == nil || err.Error() != "event stream closed" {
+		t.Errorf("unexpected error at the end of the stream: %v", err)
+	}
+	close(events)
+
+	var got []Event
+	for ev := range events {
+		got = append(got, ev)
+	}
+	checkTestStreamEvents(t, got)
+}
+
+func TestReadEventsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nobody reads the events: we must still return
+	err := ReadEvents(ctx, strings.NewReader(testStream), make(chan Event))
+	if err != context.Canceled {
+		t.Errorf("got %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestDecodeUnknownTopic(t *testing.T) {
+	ev := Event{Topic: "voluntary_exit", Data: []byte("{}")}
+	if _, err := ev.Decode(); err == nil {
+		t.Error("decoded an event of an unknown topic")
+	}
+}
+
+// A handler talking to the (test) node at `addr`
+func testHandler(addr string) *Eth2Handler {
+	return &Eth2Handler{
+		client: &eth2api.Eth2HttpClient{Addr: addr, Cli: http.DefaultClient, Codec: statusCodec{}},
+		ctx:    context.Background(),
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth/v1/events" {
+			http.NotFound(w, r)
+			return
+		}
+		if topics := r.URL.Query().Get("topics"); topics != "head,block,chain_reorg,finalized_checkpoint" {
+			http.Error(w, "unexpected topics "+topics, http.StatusBadRequest)
+			return
+		}
+		if accept := r.Header.Get("Accept"); accept != "text/event-stream" {
+			http.Error(w, "unexpected Accept header "+accept, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, testStream)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := testHandler(srv.URL).SubscribeEvents(ctx)
+
+	var got []Event
+	for {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+			continue
+		case err := <-errs:
+			if err == nil || err.Error() != "event stream closed" {
+				t.Fatalf("unexpected error at the end of the stream: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream never ended")
+		}
+		break
+	}
+
+	// The reader may have queued events right before closing
+	for len(events) > 0 {
+		got = append(got, <-events)
+	}
+	checkTestStreamEvents(t, got)
+}
+
+func TestSubscribeEventsRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no events here", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, errs := testHandler(srv.URL).SubscribeEvents(context.Background())
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "503") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error for a refused subscription")
+	}
+}
@@ -0,0 +1,96 @@
+/// This module pulls the lifecycle events of validators (deposits, exits and
+/// slashings) out of blocks, and looks up the status of validators for the
+/// lifecycle tracker.
+
+package eth2_handler
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/eth2api/client/beaconapi"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// How many validators we ask the status of per request (their indices go in
+// the query string)
+const maxStatusQueryIds = 500
+
+// Return the lifecycle events found in `block`
+func lifecycleEvents(block *Block) []db.LifecycleRow {
+	var events []db.LifecycleRow
+	add := func(kind string, position int, validator int) *db.LifecycleRow {
+		events = append(events, db.LifecycleRow{
+			Slot:         int(block.Slot),
+			Epoch:        int(trackers.ComputeEpochAtSlot(block.Slot)),
+			Kind:         kind,
+			Position:     position,
+			ValidatorIdx: validator,
+		})
+		return &events[len(events)-1]
+	}
+
+	for i, deposit := range block.Deposits {
+		e := add(db.EventDeposit, i, db.UnknownValidator)
+		e.Pubkey = deposit.Data.Pubkey.String()
+		e.Amount = int64(deposit.Data.Amount)
+	}
+	for i, exit := range block.VoluntaryExits {
+		add(db.EventVoluntaryExit, i, int(exit.Message.ValidatorIndex))
+	}
+	for i, slashing := range block.ProposerSlashings {
+		add(db.EventProposerSlashing, i, int(slashing.SignedHeader1.Message.ProposerIndex))
+	}
+	for i, slashing := range block.AttesterSlashings {
+		// Like in the spec: validators that signed both attestations
+		signed := make(map[common.ValidatorIndex]bool)
+		for _, validator := range slashing.Attestation1.AttestingIndices {
+			signed[validator] = true
+		}
+		for _, validator := range slashing.Attestation2.AttestingIndices {
+			if signed[validator] {
+				add(db.EventAttesterSlashing, i, int(validator))
+			}
+		}
+	}
+	return events
+}
+
+// Return the status of `validators` at the end of `epoch` (see
+// trackers.StatusSource)
+func (h *Eth2Handler) ValidatorStatuses(epoch common.Epoch, validators []common.ValidatorIndex) (map[common.ValidatorIndex]string, error) {
+	// The last slot of `epoch` (the state of the next one could already
+	// have processed an exit)
+	slot := trackers.ComputeStartSlotAtEpoch(epoch+1) - 1
+	statuses := make(map[common.ValidatorIndex]string, len(validators))
+
+	for start := 0; start < len(validators); start += maxStatusQueryIds {
+		end := start + maxStatusQueryIds
+		if end > len(validators) {
+			end = len(validators)
+		}
+
+		var ids []eth2api.ValidatorId
+		for _, validator := range validators[start:end] {
+			ids = append(ids, eth2api.ValidatorIdIndex(validator))
+		}
+
+		var resp []eth2api.ValidatorResponse
+		timer := metrics.TimeAPIRequest("validators")
+		exists, err := beaconapi.StateValidators(h.ctx, h.client, eth2api.StateIdSlot(slot), ids, nil, &resp)
+		timer.ObserveDuration()
+
+		what := fmt.Sprintf("validator statuses at slot #%d", slot)
+		if err := apiError(what, exists, err); err != nil {
+			return nil, err
+		}
+		for _, v := range resp {
+			statuses[v.Index] = string(v.Status)
+		}
+	}
+	return statuses, nil
+}
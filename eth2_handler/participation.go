@@ -0,0 +1,140 @@
+/// This module checks the votes of attestations against the canonical chain,
+/// to figure out which participation flags (timely source, target and head)
+/// they earn. These flags are what rewards are based on since Altair.
+
+package eth2_handler
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/eth2api/client/beaconapi"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Attestations only earn the head flag if included right in the next slot
+// (MIN_ATTESTATION_INCLUSION_DELAY)
+const headInclusionDelay = 1
+
+// Return the root of the canonical block at `slot`. If `slot` is empty, that's
+// the root of the last block before it.
+func (h *Eth2Handler) blockRootAt(slot common.Slot) (common.Root, error) {
+	var root common.Root
+	found := false
+	s := slot
+	for ; ; s-- {
+		if cached, ok := h.blockRoots[s]; ok {
+			root, found = cached, true
+			break
+		}
+
+		timer := metrics.TimeAPIRequest("block_root")
+		r, exists, err := beaconapi.BlockRoot(h.ctx, h.client, eth2api.BlockIdSlot(s))
+		timer.ObserveDuration()
+
+		err = apiError(fmt.Sprintf("block root of slot #%d", s), exists, err)
+		if err == nil {
+			root, found = r, true
+			break
+		}
+		if _, empty := err.(*NotFoundError); !empty || s == 0 {
+			return common.Root{}, err
+		}
+	}
+
+	// Remember the root for the empty slots we walked over too
+	for ; found && s <= slot; s++ {
+		h.blockRoots[s] = root
+	}
+	return root, nil
+}
+
+// Forget the block roots of the slots before `epoch`
+func (h *Eth2Handler) pruneBlockRoots(epoch common.Epoch) {
+	start := trackers.ComputeStartSlotAtEpoch(epoch)
+	for slot := range h.blockRoots {
+		if slot < start {
+			delete(h.blockRoots, slot)
+		}
+	}
+}
+
+// integer_squareroot() of the spec
+func integerSquareRoot(n uint64) uint64 {
+	x := n
+	y := (x + 1) / 2
+	for y < x {
+		x = y
+		y = (x + n/x) / 2
+	}
+	return x
+}
+
+// Return the participation flags that each attestation of `block` earns
+func (h *Eth2Handler) participationFlags(block *Block) ([]int, error) {
+	flags := make([]int, len(block.Attestations))
+	if len(block.Attestations) == 0 {
+		return flags, nil
+	}
+
+	// Attestations can be included up to an epoch after their own, so we
+	// only need the roots of the last couple of epochs
+	blockEpoch := trackers.ComputeEpochAtSlot(block.Slot)
+	if blockEpoch >= 2 {
+		h.pruneBlockRoots(blockEpoch - 2)
+	}
+
+	// The justified checkpoints that the votes of this block must match
+	var checkpoints eth2api.FinalityCheckpoints
+	timer := metrics.TimeAPIRequest("finality_checkpoints")
+	exists, err := beaconapi.FinalityCheckpoints(h.ctx, h.client, eth2api.StateIdSlot(block.Slot), &checkpoints)
+	timer.ObserveDuration()
+	if err := apiError(fmt.Sprintf("finality checkpoints at slot #%d", block.Slot), exists, err); err != nil {
+		return nil, err
+	}
+
+	sourceDelayLimit := common.Slot(integerSquareRoot(uint64(h.spec.SLOTS_PER_EPOCH)))
+	targetDelayLimit := h.spec.SLOTS_PER_EPOCH
+	if block.Fork == ForkDeneb { // EIP-7045: no more target deadline
+		targetDelayLimit = ^common.Slot(0)
+	}
+
+	for i, att := range block.Attestations {
+		data := att.Data
+		delay := block.Slot - data.Slot
+
+		expectedSource := checkpoints.PreviousJustified
+		if data.Target.Epoch == blockEpoch {
+			expectedSource = checkpoints.CurrentJustified
+		}
+		if data.Source != expectedSource {
+			continue // wrong source: no flags at all
+		}
+		if delay <= sourceDelayLimit {
+			flags[i] |= trackers.TIMELY_SOURCE_FLAG
+		}
+
+		targetRoot, err := h.blockRootAt(trackers.ComputeStartSlotAtEpoch(data.Target.Epoch))
+		if err != nil {
+			return nil, err
+		}
+		if data.Target.Root != targetRoot {
+			continue
+		}
+		if delay <= targetDelayLimit {
+			flags[i] |= trackers.TIMELY_TARGET_FLAG
+		}
+
+		headRoot, err := h.blockRootAt(data.Slot)
+		if err != nil {
+			return nil, err
+		}
+		if data.BeaconBlockRoot == headRoot && delay == headInclusionDelay {
+			flags[i] |= trackers.TIMELY_HEAD_FLAG
+		}
+	}
+	return flags, nil
+}
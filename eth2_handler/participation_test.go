@@ -0,0 +1,141 @@
+package eth2_handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+)
+
+const (
+	S = trackers.TIMELY_SOURCE_FLAG
+	T = trackers.TIMELY_TARGET_FLAG
+	H = trackers.TIMELY_HEAD_FLAG
+)
+
+// The block our test attestations are included in, in epoch #3
+const testBlockSlot = common.Slot(100)
+
+// The root of the canonical block at `slot` (every slot has one)
+func testRoot(slot common.Slot) common.Root {
+	return common.Root{byte(slot), 0xcc}
+}
+
+var testCheckpoints = eth2api.FinalityCheckpoints{
+	PreviousJustified: common.Checkpoint{Epoch: 1, Root: testRoot(32)},
+	CurrentJustified:  common.Checkpoint{Epoch: 2, Root: testRoot(64)},
+}
+
+// A handler following a chain where every slot has a block, talking to a node
+// that only knows the finality checkpoints at testBlockSlot
+func testParticipationHandler(t *testing.T) *Eth2Handler {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth/v1/beacon/states/100/finality_checkpoints" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": testCheckpoints})
+	}))
+	t.Cleanup(srv.Close)
+
+	spec := *configs.Mainnet
+	h := testHandler(srv.URL)
+	h.spec = &spec
+	h.blockRoots = make(map[common.Slot]common.Root)
+	for slot := common.Slot(32); slot <= testBlockSlot; slot++ {
+		h.blockRoots[slot] = testRoot(slot)
+	}
+	return h
+}
+
+// An attestation to the canonical chain included `delay` slots late
+func testVote(delay common.Slot) phase0.Attestation {
+	slot := testBlockSlot - delay
+	epoch := trackers.ComputeEpochAtSlot(slot)
+	source := testCheckpoints.PreviousJustified
+	if epoch == trackers.ComputeEpochAtSlot(testBlockSlot) {
+		source = testCheckpoints.CurrentJustified
+	}
+	return phase0.Attestation{Data: phase0.AttestationData{
+		Slot:            slot,
+		BeaconBlockRoot: testRoot(slot),
+		Source:          source,
+		Target:          common.Checkpoint{Epoch: epoch, Root: testRoot(trackers.ComputeStartSlotAtEpoch(epoch))},
+	}}
+}
+
+func TestParticipationFlags(t *testing.T) {
+	wrongSource := testVote(1)
+	wrongSource.Data.Source = testCheckpoints.PreviousJustified
+	wrongTarget := testVote(1)
+	wrongTarget.Data.Target.Root = common.Root{0xff}
+	wrongHead := testVote(1)
+	wrongHead.Data.BeaconBlockRoot = common.Root{0xff}
+
+	tests := []struct {
+		name   string
+		att    phase0.Attestation
+		altair int
+		deneb  int
+	}{
+		// The head flag needs the next slot
+		{"delay 1", testVote(1), S | T | H, S | T | H},
+		{"delay 2", testVote(2), S | T, S | T},
+		// The source flag needs integer_squareroot(SLOTS_PER_EPOCH) = 5
+		{"delay 5", testVote(5), S | T, S | T},
+		{"delay 6", testVote(6), T, T},
+		// The target flag needs SLOTS_PER_EPOCH, up until deneb
+		{"delay 32", testVote(32), T, T},
+		{"delay 33", testVote(33), 0, T},
+		{"delay 60", testVote(60), 0, T},
+		// Wrong votes
+		{"wrong source", wrongSource, 0, 0},
+		{"wrong target", wrongTarget, S, S},
+		{"wrong head", wrongHead, S | T, S | T},
+	}
+
+	for _, fork := range []string{ForkAltair, ForkDeneb} {
+		block := &Block{Fork: fork, Slot: testBlockSlot}
+		for _, test := range tests {
+			block.Attestations = append(block.Attestations, test.att)
+		}
+
+		flags, err := testParticipationHandler(t).participationFlags(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, test := range tests {
+			expected := test.altair
+			if fork == ForkDeneb {
+				expected = test.deneb
+			}
+			if flags[i] != expected {
+				t.Errorf("%s, %s: got flags %03b, expected %03b", fork, test.name, flags[i], expected)
+			}
+		}
+	}
+}
+
+func TestParticipationFlagsWithoutAttestations(t *testing.T) {
+	// No need to ask the node anything
+	h := testHandler("http://127.0.0.1:1")
+	flags, err := h.participationFlags(&Block{Fork: ForkAltair, Slot: testBlockSlot})
+	if err != nil || len(flags) != 0 {
+		t.Errorf("got %v (%v) for a block without attestations", flags, err)
+	}
+}
+
+func TestIntegerSquareRoot(t *testing.T) {
+	for n, expected := range map[uint64]uint64{0: 0, 1: 1, 3: 1, 4: 2, 8: 2, 32: 5, 36: 6, 1 << 40: 1 << 20} {
+		if root := integerSquareRoot(n); root != expected {
+			t.Errorf("integerSquareRoot(%d) = %d, expected %d", n, root, expected)
+		}
+	}
+}
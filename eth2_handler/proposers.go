@@ -0,0 +1,59 @@
+/// This module fetches the proposer duties, and tells the proposer tracker
+/// about the blocks we see and the slots we don't see a block in.
+
+package eth2_handler
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/eth2api/client/validatorapi"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Fetch the proposer duties of `epoch` and register them with the proposer
+// tracker, unless we already did. We can live without them (they only tell us
+// who missed a slot), so failures are just reported.
+func (h *Eth2Handler) fetchProposerDutiesIfNeeded(epoch common.Epoch) {
+	if h.proposerDutiesFetched[epoch] {
+		return
+	}
+
+	var duties eth2api.DependentProposerDuty
+	timer := metrics.TimeAPIRequest("proposer_duties")
+	_, err := validatorapi.ProposerDuties(h.ctx, h.client, epoch, &duties)
+	timer.ObserveDuration()
+
+	err = apiError(fmt.Sprintf("proposer duties of epoch #%d", epoch), true, err)
+	if _, unavailable := err.(*NodeUnavailableError); unavailable {
+		// Try again with the next block
+		fmt.Printf("[!] %v\n", err)
+		return
+	}
+	h.proposerDutiesFetched[epoch] = true
+	if err != nil {
+		// e.g. nodes that only serve the duties of recent epochs
+		fmt.Printf("[!] %v: proposers of missed slots will be unknown\n", err)
+		return
+	}
+
+	trackers.RegisterProposerDuties(duties.Data)
+}
+
+// Return the root of `block`, which we fetched with `blockId`
+func (h *Eth2Handler) blockRootOf(blockId eth2api.BlockId, block *Block) (common.Root, error) {
+	if root, ok := blockId.(eth2api.BlockIdRoot); ok {
+		h.blockRoots[block.Slot] = common.Root(root)
+		return common.Root(root), nil
+	}
+	return h.blockRootAt(block.Slot)
+}
+
+// There is no block at `slot`: its proposal was missed
+func (h *Eth2Handler) HandleEmptySlot(slot common.Slot) {
+	h.fetchProposerDutiesIfNeeded(trackers.ComputeEpochAtSlot(slot))
+	trackers.RegisterEmptySlot(slot)
+}
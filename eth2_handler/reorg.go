@@ -0,0 +1,100 @@
+/// This module makes sure that the blocks we pass to the trackers form a
+/// chain. Every block must build on the last block we processed: if it
+/// doesn't, either the chain reorganized and we have to roll back the blocks
+/// that got orphaned, or we missed some blocks and have to catch up on them.
+
+package eth2_handler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Walk back the parents of `block` until we find a block we have processed.
+// Roll back the blocks we processed after that one, and process the blocks of
+// the chain of `block` that we haven't seen, so that `block` can be processed
+// next.
+func (h *Eth2Handler) followChain(block *Block) error {
+	horizon, ok := trackers.JournalHorizon()
+	if !ok { // nothing to compare with
+		return nil
+	}
+
+	// The blocks of the chain we haven't seen, newest first
+	var unseen []*Block
+
+	parentRoot := block.ParentRoot
+	ancestorSlot, known := trackers.JournaledBlock(parentRoot)
+	for !known {
+		parent, err := h.fetchBlock(eth2api.BlockIdRoot(parentRoot))
+		if err != nil {
+			return err
+		}
+		metrics.BlocksFetched.Inc()
+		parent.Root = parentRoot
+
+		if parent.Slot < horizon {
+			// We never saw where the chain forked off: none of the
+			// blocks we processed are part of it
+			ancestorSlot = parent.Slot
+			break
+		}
+		unseen = append(unseen, parent)
+		parentRoot = parent.ParentRoot
+		ancestorSlot, known = trackers.JournaledBlock(parentRoot)
+	}
+
+	h.rollBackBlocksAfter(ancestorSlot)
+
+	for i := len(unseen) - 1; i >= 0; i-- {
+		b := unseen[i]
+		fmt.Printf("[!] Catching up on block %s of slot #%d\n", b.Root, b.Slot)
+		h.blockRoots[b.Slot] = b.Root
+		err := h.processBlock(b)
+
+		// Like in the normal case, the rest of the block was handled
+		var unknownCommittee *trackers.UnknownCommitteeError
+		if errors.As(err, &unknownCommittee) {
+			fmt.Printf("[!] %v\n", err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Switch to the chain of `head`, which the node says it reorganized to: roll
+// back the blocks we processed that are not part of it, and catch up on the
+// blocks of it we haven't seen. Return the slot of `head`.
+func (h *Eth2Handler) FollowReorg(head common.Root) (int, error) {
+	if slot, seen := trackers.JournaledBlock(head); seen {
+		// The chain went back to a block we processed: whatever we
+		// processed after it is orphaned
+		h.rollBackBlocksAfter(slot)
+		return int(slot), nil
+	}
+	return h.FetchAndProcessBlockByRoot(head)
+}
+
+func (h *Eth2Handler) rollBackBlocksAfter(slot common.Slot) {
+	if n := trackers.RollBackBlocksAfter(slot); n > 0 {
+		fmt.Printf("[!] Chain reorganized after slot #%d: rolled back %d blocks\n", slot, n)
+		h.forgetBlockRootsAfter(slot)
+	}
+}
+
+// Forget the block roots we cached for the slots after `slot`: they were the
+// roots of blocks that got orphaned
+func (h *Eth2Handler) forgetBlockRootsAfter(slot common.Slot) {
+	for s := range h.blockRoots {
+		if s > slot {
+			delete(h.blockRoots, s)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+/// This module gets the balances and rewards of validators out of the beacon
+/// node, for the reward tracker. Balances come from the states at the epoch
+/// boundaries, and the breakdown of the rewards from the rewards API.
+
+package eth2_handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/trackers"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/eth2api/client/beaconapi"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Ask for the balances of at most this many validators at once, to keep the
+// query string short
+const maxBalanceQueryIds = 500
+
+// An amount of Gwei that can be negative (penalties). The rewards API quotes
+// them, like every other number.
+type signedGwei int64
+
+func (g *signedGwei) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*g = signedGwei(v)
+	return nil
+}
+
+// Rewards of a validator for the attestations of an epoch
+type attestationRewards struct {
+	ValidatorIndex common.ValidatorIndex `json:"validator_index"`
+	Head           signedGwei            `json:"head"`
+	Target         signedGwei            `json:"target"`
+	Source         signedGwei            `json:"source"`
+	InclusionDelay signedGwei            `json:"inclusion_delay"` // phase0 only
+	Inactivity     signedGwei            `json:"inactivity"`
+}
+
+type attestationRewardsResponse struct {
+	TotalRewards []attestationRewards `json:"total_rewards"`
+}
+
+type blockRewardsResponse struct {
+	ProposerIndex common.ValidatorIndex `json:"proposer_index"`
+	Total         signedGwei            `json:"total"`
+}
+
+type syncCommitteeReward struct {
+	ValidatorIndex common.ValidatorIndex `json:"validator_index"`
+	Reward         signedGwei            `json:"reward"`
+}
+
+// Split `amount` into a reward or a penalty
+func addReward(row *db.RewardRow, reward *int64, amount signedGwei) {
+	if amount < 0 {
+		row.Penalties += int64(amount)
+	} else {
+		*reward += int64(amount)
+	}
+}
+
+// Return the balances and rewards of `validators` in `epoch` (see
+// trackers.RewardSource). `blocks` are the proposals of the epoch.
+//
+// Fails if any of it can't be fetched: we don't want to store half of the
+// rewards of an epoch.
+func (h *Eth2Handler) EpochRewards(epoch common.Epoch, validators []common.ValidatorIndex, blocks []db.ProposalRow) ([]db.RewardRow, error) {
+	rows := make(map[common.ValidatorIndex]*db.RewardRow, len(validators))
+	for _, validator := range validators {
+		rows[validator] = &db.RewardRow{ValidatorIdx: int(validator), Epoch: int(epoch)}
+	}
+
+	start, err := h.startBalances(trackers.ComputeStartSlotAtEpoch(epoch), validators)
+	if err != nil {
+		return nil, err
+	}
+	endSlot := trackers.ComputeStartSlotAtEpoch(epoch + 1)
+	end, err := h.balances(endSlot, validators)
+	if err != nil {
+		return nil, err
+	}
+	h.lastBalancesSlot, h.lastBalances = endSlot, end
+
+	for validator, row := range rows {
+		row.Balance = int64(end[validator])
+		row.Delta = int64(end[validator]) - int64(start[validator])
+	}
+
+	if err := h.attestationRewards(epoch, rows); err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if block.Status != db.ProposalProposed {
+			continue
+		}
+		if err := h.blockRewards(block, rows); err != nil {
+			return nil, err
+		}
+		if err := h.syncCommitteeRewards(epoch, block, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]db.RewardRow, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	return result, nil
+}
+
+// Return the balances of `validators` in the state of `slot`, which starts an
+// epoch. We usually have most of them already from the end of the last epoch.
+func (h *Eth2Handler) startBalances(slot common.Slot, validators []common.ValidatorIndex) (map[common.ValidatorIndex]common.Gwei, error) {
+	if h.lastBalances == nil || h.lastBalancesSlot != slot {
+		return h.balances(slot, validators)
+	}
+
+	var missing []common.ValidatorIndex
+	for _, validator := range validators {
+		if _, ok := h.lastBalances[validator]; !ok {
+			missing = append(missing, validator)
+		}
+	}
+	result, err := h.balances(slot, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, validator := range validators {
+		if balance, ok := h.lastBalances[validator]; ok {
+			result[validator] = balance
+		}
+	}
+	return result, nil
+}
+
+// Return the balances of `validators` in the state of `slot`
+func (h *Eth2Handler) balances(slot common.Slot, validators []common.ValidatorIndex) (map[common.ValidatorIndex]common.Gwei, error) {
+	what := fmt.Sprintf("validator balances at slot #%d", slot)
+	result := make(map[common.ValidatorIndex]common.Gwei, len(validators))
+
+	// (An empty list of ids would get us the balances of everyone)
+	for start := 0; start < len(validators); start += maxBalanceQueryIds {
+		end := start + maxBalanceQueryIds
+		if end > len(validators) {
+			end = len(validators)
+		}
+		ids := make([]eth2api.ValidatorId, 0, end-start)
+		for _, validator := range validators[start:end] {
+			ids = append(ids, eth2api.ValidatorIdIndex(validator))
+		}
+
+		var balances []eth2api.ValidatorBalanceResponse
+		timer := metrics.TimeAPIRequest("validator_balances")
+		exists, err := beaconapi.StateValidatorBalances(h.ctx, h.client, eth2api.StateIdSlot(slot), ids, &balances)
+		timer.ObserveDuration()
+
+		if err := apiError(what, exists, err); err != nil {
+			return nil, err
+		}
+		for _, b := range balances {
+			result[b.Index] = b.Balance
+		}
+	}
+
+	// A balance we don't have would make up a huge delta
+	for _, validator := range validators {
+		if _, ok := result[validator]; !ok {
+			return nil, &NotFoundError{What: fmt.Sprintf("balance of validator %d at slot #%d", validator, slot)}
+		}
+	}
+	return result, nil
+}
+
+// Add the attestation rewards of `epoch` to `rows`
+func (h *Eth2Handler) attestationRewards(epoch common.Epoch, rows map[common.ValidatorIndex]*db.RewardRow) error {
+	body := make([]string, 0, len(rows))
+	for validator := range rows {
+		body = append(body, strconv.FormatUint(uint64(validator), 10))
+	}
+
+	var rewards attestationRewardsResponse
+	timer := metrics.TimeAPIRequest("attestation_rewards")
+	exists, err := eth2api.SimpleRequest(h.ctx, h.client,
+		eth2api.BodyPOST(fmt.Sprintf("/eth/v1/beacon/rewards/attestations/%d", epoch), body), eth2api.Wrap(&rewards))
+	timer.ObserveDuration()
+
+	what := fmt.Sprintf("attestation rewards of epoch #%d", epoch)
+	if err := apiError(what, exists, err); err != nil {
+		return err
+	}
+
+	for _, r := range rewards.TotalRewards {
+		row := rows[r.ValidatorIndex]
+		if row == nil {
+			continue
+		}
+		for _, amount := range []signedGwei{r.Head, r.Target, r.Source, r.InclusionDelay} {
+			addReward(row, &row.AttestationReward, amount)
+		}
+		row.Penalties += int64(r.Inactivity)
+	}
+	return nil
+}
+
+// Add the reward of the proposer of `block` to `rows`, if it's one of ours
+func (h *Eth2Handler) blockRewards(block db.ProposalRow, rows map[common.ValidatorIndex]*db.RewardRow) error {
+	row := rows[common.ValidatorIndex(block.ProposerIdx)]
+	if row == nil {
+		return nil
+	}
+
+	var rewards blockRewardsResponse
+	timer := metrics.TimeAPIRequest("block_rewards")
+	exists, err := eth2api.SimpleRequest(h.ctx, h.client,
+		eth2api.FmtGET("/eth/v1/beacon/rewards/blocks/%s", block.BlockRoot), eth2api.Wrap(&rewards))
+	timer.ObserveDuration()
+
+	what := fmt.Sprintf("block rewards of slot #%d", block.Slot)
+	if err := apiError(what, exists, err); err != nil {
+		return err
+	}
+
+	addReward(row, &row.ProposalReward, rewards.Total)
+	return nil
+}
+
+// Add the rewards that `block` gave to the sync committee members among `rows`
+func (h *Eth2Handler) syncCommitteeRewards(epoch common.Epoch, block db.ProposalRow, rows map[common.ValidatorIndex]*db.RewardRow) error {
+	var body []string
+	for _, validator := range h.syncCommitteeTracker.SyncCommitteeOfEpoch(epoch) {
+		if rows[validator] != nil {
+			body = append(body, strconv.FormatUint(uint64(validator), 10))
+		}
+	}
+	if len(body) == 0 { // none of ours in the committee (or no committee at all)
+		return nil
+	}
+
+	var rewards []syncCommitteeReward
+	timer := metrics.TimeAPIRequest("sync_committee_rewards")
+	exists, err := eth2api.SimpleRequest(h.ctx, h.client,
+		eth2api.BodyPOST(fmt.Sprintf("/eth/v1/beacon/rewards/sync_committee/%s", block.BlockRoot), body), eth2api.Wrap(&rewards))
+	timer.ObserveDuration()
+
+	what := fmt.Sprintf("sync committee rewards of slot #%d", block.Slot)
+	if err := apiError(what, exists, err); err != nil {
+		return err
+	}
+
+	for _, r := range rewards {
+		if row := rows[r.ValidatorIndex]; row != nil {
+			addReward(row, &row.SyncReward, r.Reward)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package eth2_handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// A node where validator i has a balance of i+slot Gwei at every slot (and no
+// rewards at all), except for validators from 2000 on which it doesn't know.
+// Counts the balance requests for each slot.
+func testRewardsHandler(t *testing.T, requests map[common.Slot]int) *Eth2Handler {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/eth/v1/beacon/rewards/attestations/") {
+			fmt.Fprint(w, `{"data": {"total_rewards": []}}`)
+			return
+		}
+
+		var slot common.Slot
+		if _, err := fmt.Sscanf(r.URL.Path, "/eth/v1/beacon/states/%d/validator_balances", &slot); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ids := strings.Split(r.URL.Query().Get("id"), ",")
+		if len(ids) > maxBalanceQueryIds {
+			http.Error(w, "too many ids", http.StatusBadRequest)
+			return
+		}
+		requests[slot]++
+
+		var balances []eth2api.ValidatorBalanceResponse
+		for _, id := range ids {
+			index, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				http.Error(w, "bad id "+id, http.StatusBadRequest)
+				return
+			}
+			if index < 2000 {
+				balances = append(balances, eth2api.ValidatorBalanceResponse{
+					Index: common.ValidatorIndex(index), Balance: common.Gwei(index) + common.Gwei(slot)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": balances})
+	}))
+	t.Cleanup(srv.Close)
+	return testHandler(srv.URL)
+}
+
+func testValidators(from, to common.ValidatorIndex) []common.ValidatorIndex {
+	var validators []common.ValidatorIndex
+	for v := from; v < to; v++ {
+		validators = append(validators, v)
+	}
+	return validators
+}
+
+func TestEpochRewardsBalances(t *testing.T) {
+	requests := map[common.Slot]int{}
+	h := testRewardsHandler(t, requests)
+
+	// Epoch #3 goes from slot #96 to the start of epoch #4, at slot #128
+	rows, err := h.EpochRewards(3, testValidators(0, 1200), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1200 {
+		t.Fatalf("got %d rows, expected 1200", len(rows))
+	}
+	for _, row := range rows {
+		if row.Balance != int64(row.ValidatorIdx)+128 || row.Delta != 32 {
+			t.Errorf("wrong balance for validator %d: %+v", row.ValidatorIdx, row)
+		}
+	}
+	if requests[96] != 3 || requests[128] != 3 {
+		t.Errorf("expected 3 batches of balances per state: %v", requests)
+	}
+
+	// The balances at the start of epoch #4 are the ones we already have,
+	// except for the new validator
+	rows, err = h.EpochRewards(4, testValidators(0, 1201), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1201 {
+		t.Fatalf("got %d rows, expected 1201", len(rows))
+	}
+	for _, row := range rows {
+		if row.Balance != int64(row.ValidatorIdx)+160 || row.Delta != 32 {
+			t.Errorf("wrong balance for validator %d: %+v", row.ValidatorIdx, row)
+		}
+	}
+	if requests[128] != 4 || requests[160] != 3 {
+		t.Errorf("the balances at slot #128 should only be fetched for the new validator: %v", requests)
+	}
+}
+
+func TestEpochRewardsMissingBalance(t *testing.T) {
+	h := testRewardsHandler(t, map[common.Slot]int{})
+
+	_, err := h.EpochRewards(3, []common.ValidatorIndex{1, 2000}, nil)
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("expected a NotFoundError for the unknown validator, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+/// This module keeps track of the slot clock of the beacon chain, so that we
+/// can fetch each block at a known point into its slot instead of following a
+/// free-running timer that drifts against the chain.
+
+package eth2_handler
+
+import (
+	"time"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+type SlotClock struct {
+	// When slot zero started
+	genesisTime time.Time
+
+	// How long each slot lasts (SECONDS_PER_SLOT in the spec)
+	slotDuration time.Duration
+}
+
+func InitSlotClock(genesisTime common.Timestamp, secondsPerSlot common.Timestamp) *SlotClock {
+	return &SlotClock{
+		genesisTime:  time.Unix(int64(genesisTime), 0),
+		slotDuration: time.Duration(secondsPerSlot) * time.Second,
+	}
+}
+
+// Return the time at which `slot` starts
+func (c *SlotClock) SlotStart(slot common.Slot) time.Time {
+	return c.genesisTime.Add(time.Duration(slot) * c.slotDuration)
+}
+
+// Return the slot we are currently in (zero if the chain has not started yet)
+func (c *SlotClock) CurrentSlot() common.Slot {
+	sinceGenesis := time.Since(c.genesisTime)
+	if sinceGenesis < 0 {
+		return 0
+	}
+	return common.Slot(sinceGenesis / c.slotDuration)
+}
+
+func (c *SlotClock) SlotDuration() time.Duration {
+	return c.slotDuration
+}
+
+// Block until `offset` into `slot`. Returns immediately if that's in the past.
+func (c *SlotClock) SleepUntil(slot common.Slot, offset time.Duration) {
+	time.Sleep(time.Until(c.SlotStart(slot).Add(offset)))
+}
@@ -0,0 +1,159 @@
+/// This module figures out the network spec (presets and config) that visit
+/// should follow, so that it can be pointed at testnets and devnets and not
+/// just mainnet.
+
+package eth2_handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/asn-d6/visit/config"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"gopkg.in/yaml.v3"
+)
+
+// Start from the preset named `preset` ("mainnet" or "minimal")
+func presetSpec(preset string) (*common.Spec, error) {
+	var spec common.Spec
+	switch preset {
+	case "mainnet":
+		spec = *configs.Mainnet
+	case "minimal":
+		spec = *configs.Minimal
+	default:
+		return nil, fmt.Errorf("unknown preset %q", preset)
+	}
+	return &spec, nil
+}
+
+// The epochs of the forks that zrnt doesn't know about: we pick them out of
+// the spec ourselves. BELLATRIX_FORK_EPOCH is the new name of
+// MERGE_FORK_EPOCH.
+type forkEpochs struct {
+	Bellatrix common.Epoch `yaml:"BELLATRIX_FORK_EPOCH"`
+	Capella   common.Epoch `yaml:"CAPELLA_FORK_EPOCH"`
+	Deneb     common.Epoch `yaml:"DENEB_FORK_EPOCH"`
+	Electra   common.Epoch `yaml:"ELECTRA_FORK_EPOCH"`
+	Fulu      common.Epoch `yaml:"FULU_FORK_EPOCH"`
+}
+
+// Like in the presets, forks don't happen unless the spec says so
+func farFutureForks() forkEpochs {
+	farFuture := ^common.Epoch(0)
+	return forkEpochs{Bellatrix: farFuture, Capella: farFuture, Deneb: farFuture, Electra: farFuture, Fulu: farFuture}
+}
+
+// Override `spec` and `forks` with the values of the spec YAML in `data`
+func applySpecYaml(spec *common.Spec, forks *forkEpochs, data []byte) error {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	return applySpecNode(spec, forks, &node)
+}
+
+func applySpecNode(spec *common.Spec, forks *forkEpochs, node *yaml.Node) error {
+	if node.Kind == 0 { // empty document
+		return nil
+	}
+	if err := node.Decode(spec); err != nil {
+		return err
+	}
+	return node.Decode(forks)
+}
+
+// Override `spec` and `forks` with the values of the YAML config at `path`.
+// The file can hold config values, preset values or both.
+func loadSpecFile(spec *common.Spec, forks *forkEpochs, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read spec file: %w", err)
+	}
+	if err := applySpecYaml(spec, forks, data); err != nil {
+		return fmt.Errorf("failed to parse spec file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Override `spec` and `forks` with the spec the node is running
+// (/eth/v1/config/spec).
+//
+// The node returns every value as a JSON string, while the zrnt types expect
+// plain numbers for some of them. So we go through the same YAML decoding
+// that the spec files go through, which is forgiving about that.
+func (h *Eth2Handler) loadSpecFromNode(spec *common.Spec, forks *forkEpochs) error {
+	var values map[string]json.RawMessage
+	if err := eth2api.MinimalRequest(h.ctx, h.client, eth2api.PlainGET("/eth/v1/config/spec"), eth2api.Wrap(&values)); err != nil {
+		return fmt.Errorf("failed to fetch spec from node: %w", err)
+	}
+	if err := applySpecNode(spec, forks, specValuesNode(values)); err != nil {
+		return fmt.Errorf("failed to parse spec from node: %w", err)
+	}
+	return nil
+}
+
+// Turn the spec `values` of the node into a YAML mapping of plain scalars,
+// which get their type from their value like in a spec file. Values that are
+// not scalars (e.g. BLOB_SCHEDULE, a list) are none of our business: skip
+// them.
+func specValuesNode(values map[string]json.RawMessage) *yaml.Node {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	for _, key := range keys {
+		var value interface{}
+		if err := json.Unmarshal(values[key], &value); err != nil {
+			continue
+		}
+
+		var scalar string
+		switch v := value.(type) {
+		case string:
+			scalar = v
+		case float64, bool:
+			// Keep numbers the way the node wrote them
+			scalar = string(values[key])
+		default:
+			continue
+		}
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: scalar})
+	}
+	return mapping
+}
+
+// Build the spec to use: start from the configured preset, then apply the
+// spec file and the node's spec, if asked to. Also return the epochs of the
+// forks zrnt doesn't know about.
+func (h *Eth2Handler) loadSpec(cfg *config.Config) (*common.Spec, forkEpochs, error) {
+	forks := farFutureForks()
+	spec, err := presetSpec(cfg.Preset)
+	if err != nil {
+		return nil, forks, err
+	}
+
+	if cfg.SpecFile != "" {
+		if err := loadSpecFile(spec, &forks, cfg.SpecFile); err != nil {
+			return nil, forks, err
+		}
+	}
+
+	if cfg.SpecFromNode {
+		if err := h.loadSpecFromNode(spec, &forks); err != nil {
+			return nil, forks, err
+		}
+	}
+
+	return spec, forks, nil
+}
@@ -0,0 +1,60 @@
+package eth2_handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/configs"
+)
+
+// What a recent node serves at /eth/v1/config/spec (abridged), with values
+// that don't make it as plain YAML
+const testNodeSpec = `{"data": {
+	"CONFIG_NAME": "testnet: the sequel",
+	"PRESET_BASE": "minimal",
+	"SLOTS_PER_EPOCH": "8",
+	"SECONDS_PER_SLOT": "6",
+	"ALTAIR_FORK_EPOCH": "0",
+	"BELLATRIX_FORK_EPOCH": "2",
+	"CAPELLA_FORK_EPOCH": "4",
+	"DENEB_FORK_EPOCH": "18446744073709551615",
+	"GENESIS_FORK_VERSION": "0x10000038",
+	"DEPOSIT_CONTRACT_ADDRESS": "0x4242424242424242424242424242424242424242",
+	"BLOB_SCHEDULE": [{"EPOCH": "269568", "MAX_BLOBS_PER_BLOCK": "6"}],
+	"SOME_OBJECT": {"A": "1"},
+	"SOME_NULL": null
+}}`
+
+func TestLoadSpecFromNode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth/v1/config/spec" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, testNodeSpec)
+	}))
+	defer srv.Close()
+
+	spec := *configs.Mainnet
+	forks := farFutureForks()
+	if err := testHandler(srv.URL).loadSpecFromNode(&spec, &forks); err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.SLOTS_PER_EPOCH != 8 || spec.SECONDS_PER_SLOT != 6 {
+		t.Errorf("wrong slots: %d slots per epoch of %d seconds", spec.SLOTS_PER_EPOCH, spec.SECONDS_PER_SLOT)
+	}
+	if spec.PRESET_BASE != "minimal" {
+		t.Errorf("wrong preset: %q", spec.PRESET_BASE)
+	}
+	if spec.GENESIS_FORK_VERSION.String() != "0x10000038" {
+		t.Errorf("wrong genesis fork version: %s", spec.GENESIS_FORK_VERSION)
+	}
+	if spec.ALTAIR_FORK_EPOCH != 0 || forks.Bellatrix != 2 || forks.Capella != 4 || forks.Deneb != ^common.Epoch(0) {
+		t.Errorf("wrong fork epochs: altair %d, %+v", spec.ALTAIR_FORK_EPOCH, forks)
+	}
+}
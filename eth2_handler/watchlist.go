@@ -0,0 +1,85 @@
+/// This module loads the watchlist file, resolving the BLS pubkeys in it to
+/// validator indices through the beacon node.
+
+package eth2_handler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/asn-d6/visit/metrics"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/eth2api/client/beaconapi"
+)
+
+// Return the validator indices of the watchlist file at `path`: one validator
+// index or BLS pubkey per line. Empty lines and lines starting with '#' are
+// skipped. Pubkeys the node doesn't know (e.g. deposits still in the queue)
+// are reported and left out.
+func (h *Eth2Handler) LoadWatchlist(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var indices []int
+	var pubkeys []eth2api.ValidatorId
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := eth2api.ParseValidatorId(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid validator %q: %w", path, n, line, err)
+		}
+		if index, ok := id.(eth2api.ValidatorIdIndex); ok {
+			indices = append(indices, int(index))
+		} else {
+			pubkeys = append(pubkeys, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	resolved, err := h.resolvePubkeys(pubkeys)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[!] Watching %d validators from %s (%d of them by pubkey)\n", len(indices)+len(resolved), path, len(resolved))
+	return append(indices, resolved...), nil
+}
+
+// Return the validator indices of `pubkeys`, according to the head state
+func (h *Eth2Handler) resolvePubkeys(pubkeys []eth2api.ValidatorId) ([]int, error) {
+	var indices []int
+	for start := 0; start < len(pubkeys); start += maxStatusQueryIds {
+		end := start + maxStatusQueryIds
+		if end > len(pubkeys) {
+			end = len(pubkeys)
+		}
+
+		var resp []eth2api.ValidatorResponse
+		timer := metrics.TimeAPIRequest("validators")
+		exists, err := beaconapi.StateValidators(h.ctx, h.client, eth2api.StateHead, pubkeys[start:end], nil, &resp)
+		timer.ObserveDuration()
+
+		if err := apiError("validators of the watchlist", exists, err); err != nil {
+			return nil, err
+		}
+		for _, v := range resp {
+			indices = append(indices, int(v.Index))
+		}
+	}
+
+	if missing := len(pubkeys) - len(indices); missing > 0 {
+		fmt.Printf("[!] %d pubkeys of the watchlist are not known to the node, ignoring them\n", missing)
+	}
+	return indices, nil
+}
@@ -0,0 +1,98 @@
+package eth2_handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// The pubkey of validator #`index` on our test node
+func testPubkey(index int) string {
+	return fmt.Sprintf("0x%096x", index+1)
+}
+
+// A node that knows the first `validators` validators, and counts the queries
+// it gets in `queries`
+func testValidatorsHandler(t *testing.T, validators int, queries *int) *Eth2Handler {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth/v1/beacon/states/head/validators" {
+			http.NotFound(w, r)
+			return
+		}
+		*queries++
+		resp := []eth2api.ValidatorResponse{}
+		for _, id := range strings.Split(r.URL.Query().Get("id"), ",") {
+			for index := 0; index < validators; index++ {
+				if id == testPubkey(index) {
+					resp = append(resp, eth2api.ValidatorResponse{Index: common.ValidatorIndex(index), Status: eth2api.ValidatorStatus("active_ongoing")})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": resp})
+	}))
+	t.Cleanup(srv.Close)
+	return testHandler(srv.URL)
+}
+
+func writeWatchlist(t *testing.T, lines []string) string {
+	path := filepath.Join(t.TempDir(), "watchlist.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadWatchlist(t *testing.T) {
+	var queries int
+	h := testValidatorsHandler(t, 1000, &queries)
+
+	// Two indices, the pubkeys of validators #100 to #100+maxStatusQueryIds
+	// (so that it takes two queries), and the pubkey of a deposit still in
+	// the queue
+	lines := []string{"# the validators of our staking pool", "7", "", "  12  "}
+	expected := []int{7, 12}
+	for index := 100; index <= 100+maxStatusQueryIds; index++ {
+		lines = append(lines, testPubkey(index))
+		expected = append(expected, index)
+	}
+	lines = append(lines, testPubkey(5000))
+
+	indices, err := h.LoadWatchlist(writeWatchlist(t, lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indices, expected) {
+		t.Errorf("got %d validators %v, expected %d validators %v", len(indices), indices, len(expected), expected)
+	}
+	if queries != 2 {
+		t.Errorf("asked the node %d times, expected 2", queries)
+	}
+}
+
+func TestLoadWatchlistOnlyIndices(t *testing.T) {
+	// No pubkeys, no need to ask the node anything
+	var queries int
+	h := testValidatorsHandler(t, 0, &queries)
+	indices, err := h.LoadWatchlist(writeWatchlist(t, []string{"3", "# 4", "5"}))
+	if err != nil || !reflect.DeepEqual(indices, []int{3, 5}) || queries != 0 {
+		t.Errorf("got %v (%v) after %d queries, expected [3 5] without any", indices, err, queries)
+	}
+}
+
+func TestLoadWatchlistInvalidLine(t *testing.T) {
+	var queries int
+	h := testValidatorsHandler(t, 0, &queries)
+	_, err := h.LoadWatchlist(writeWatchlist(t, []string{"3", "0x1234"}))
+	if err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("expected an error about line 2, got %v", err)
+	}
+}
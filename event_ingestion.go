@@ -0,0 +1,132 @@
+/// Event driven ingestion: instead of polling every slot, follow the event
+/// stream of the beacon node and process blocks as soon as they get imported.
+/// Falls back to polling whenever the stream drops.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/asn-d6/visit/eth2_handler"
+	"github.com/asn-d6/visit/trackers"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+func (m *Visit) do_the_event_ingestion() {
+	m.start_from_current_slot()
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, errs := m.eth2Handler.SubscribeEvents(ctx)
+		err := m.follow_events(events, errs)
+		cancel()
+
+		// Stream dropped: poll the next slot, and try subscribing again
+		fmt.Printf("[!] Event stream dropped (%v). Falling back to polling...\n", err)
+		m.poll_next_slot()
+	}
+}
+
+// Drive the trackers from the event stream until it drops. Returns the reason
+// the stream dropped.
+func (m *Visit) follow_events(events <-chan eth2_handler.Event, errs <-chan error) error {
+	return read_events(events, errs, m.handle_event)
+}
+
+// Pass every event of the stream to `handle` until the stream drops, and
+// return the reason it dropped
+func read_events(events <-chan eth2_handler.Event, errs <-chan error, handle func(eth2_handler.Event)) error {
+	for {
+		select {
+		case ev := <-events:
+			handle(ev)
+		case err := <-errs:
+			// The stream queued its last events before dropping: handle
+			// them, rather than fetching their blocks all over again
+			for len(events) > 0 {
+				handle(<-events)
+			}
+			return err
+		}
+	}
+}
+
+func (m *Visit) handle_event(ev eth2_handler.Event) {
+	payload, err := ev.Decode()
+	if err != nil {
+		fmt.Printf("[!] Ignoring event: %v\n", err)
+		return
+	}
+
+	switch e := payload.(type) {
+	case *eth2_handler.BlockEvent:
+		m.handle_block_event(e)
+	case *eth2_handler.HeadEvent:
+		fmt.Printf("[*] New head at slot #%d: %s\n", e.Slot, e.Block)
+	case *eth2_handler.ChainReorgEvent:
+		fmt.Printf("[!] Chain reorg of depth %d at slot #%d: %s -> %s\n",
+			e.Depth, e.Slot, e.OldHeadBlock, e.NewHeadBlock)
+		m.handle_chain_reorg(e)
+	case *eth2_handler.FinalizedCheckpointEvent:
+		fmt.Printf("[*] Epoch #%d finalized: %s\n", e.Epoch, e.Block)
+		// Blocks up to the checkpoint can't be reorged anymore
+		if n := trackers.FinalizeBlocksUpTo(trackers.ComputeStartSlotAtEpoch(e.Epoch)); n > 0 {
+			fmt.Printf("[*] Dropped %d finalized blocks from the reorg journal\n", n)
+		}
+	}
+}
+
+// Switch to the new head of the chain right away, rolling back the blocks
+// that got orphaned
+func (m *Visit) handle_chain_reorg(e *eth2_handler.ChainReorgEvent) {
+	if int(e.Slot) >= m.nextSlotToFetch {
+		// A head we haven't reached yet: process it like a new block,
+		// which rolls back what it orphans
+		m.handle_block_event(&eth2_handler.BlockEvent{Slot: e.Slot, Block: e.NewHeadBlock})
+		return
+	}
+
+	for {
+		slot, err := m.eth2Handler.FollowReorg(e.NewHeadBlock)
+		if err == nil {
+			// The slots after the new head have to be fetched again: the
+			// blocks we processed there are gone
+			m.nextSlotToFetch = slot + 1
+			return
+		}
+		if m.handle_error(err, e.Slot) == actionSkip {
+			return
+		}
+	}
+}
+
+func (m *Visit) handle_block_event(e *eth2_handler.BlockEvent) {
+	if int(e.Slot) < m.nextSlotToFetch {
+		// We have already been through this slot (e.g. a competing block).
+		// If this block becomes the head, the node sends a chain_reorg
+		// event and we switch to it then.
+		fmt.Printf("[!] Ignoring block %s for already processed slot #%d\n", e.Block, e.Slot)
+		return
+	}
+
+	// If we skipped any slots (empty slots, or events we lost while
+	// reconnecting), go through them by slot number first
+	for slot := common.Slot(m.nextSlotToFetch); slot < e.Slot; slot++ {
+		if m.fetch_past_slot(slot) {
+			m.block_processed()
+		}
+	}
+
+	m.nextSlotToFetch = int(e.Slot) + 1
+	for {
+		_, err := m.eth2Handler.FetchAndProcessBlockByRoot(e.Block)
+		if err == nil {
+			m.block_processed()
+			return
+		}
+		if m.handle_error(err, e.Slot) == actionSkip {
+			return
+		}
+	}
+}
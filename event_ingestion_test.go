@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/asn-d6/visit/eth2_handler"
+)
+
+func TestReadEventsDrainsBeforeDropping(t *testing.T) {
+	// The stream dropped with events still queued
+	events := make(chan eth2_handler.Event, 10)
+	errs := make(chan error, 1)
+	for i := 0; i < 5; i++ {
+		events <- eth2_handler.Event{Topic: eth2_handler.TopicBlock}
+	}
+	dropped := errors.New("event stream closed")
+	errs <- dropped
+
+	handled := 0
+	err := read_events(events, errs, func(eth2_handler.Event) { handled++ })
+	if err != dropped {
+		t.Errorf("got %v, expected %v", err, dropped)
+	}
+	if handled != 5 {
+		t.Errorf("handled %d events, expected 5", handled)
+	}
+}
@@ -0,0 +1,202 @@
+/// This module gets the data out of the database and into files that
+/// notebooks (pandas, duckdb, ...) can read directly: CSV, JSON Lines or
+/// Parquet.
+
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/asn-d6/visit/config"
+	"github.com/asn-d6/visit/db"
+)
+
+// A row of the export
+type Row struct {
+	ValidatorIdx int    `json:"validator_idx"`
+	Epoch        int    `json:"epoch"`
+	Distance     int    `json:"distance"`
+	Status       string `json:"status"`
+
+	// Inclusion distance not counting empty slots (what Status is based on)
+	EffectiveDistance int `json:"effective_distance"`
+
+	// Participation flags, also broken down
+	Flags        int  `json:"flags"`
+	TimelySource bool `json:"timely_source"`
+	TimelyTarget bool `json:"timely_target"`
+	TimelyHead   bool `json:"timely_head"`
+
+	// Status of missing validators according to the beacon node, if known
+	ValidatorStatus string `json:"validator_status"`
+}
+
+func newRow(r db.ActivityRow) *Row {
+	return &Row{
+		ValidatorIdx:      r.ValidatorIdx,
+		Epoch:             r.Epoch,
+		Distance:          r.Distance,
+		Status:            db.DistanceStatus(r.EffectiveDistance, r.ValidatorStatus),
+		EffectiveDistance: r.EffectiveDistance,
+		Flags:             r.Flags,
+		TimelySource:      r.Flags&db.FlagTimelySource != 0,
+		TimelyTarget:      r.Flags&db.FlagTimelyTarget != 0,
+		TimelyHead:        r.Flags&db.FlagTimelyHead != 0,
+		ValidatorStatus:   r.ValidatorStatus,
+	}
+}
+
+// Writes rows in some format
+type rowWriter interface {
+	Write(row *Row) error
+	// Flush everything out. Must be called once we are done.
+	Close() error
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(out io.Writer) (*csvWriter, error) {
+	w := csv.NewWriter(out)
+	if err := w.Write([]string{"validator_idx", "epoch", "distance", "status", "effective_distance",
+		"flags", "timely_source", "timely_target", "timely_head", "validator_status"}); err != nil {
+		return nil, err
+	}
+	return &csvWriter{w}, nil
+}
+
+func (c *csvWriter) Write(row *Row) error {
+	return c.w.Write([]string{
+		strconv.Itoa(row.ValidatorIdx),
+		strconv.Itoa(row.Epoch),
+		strconv.Itoa(row.Distance),
+		row.Status,
+		strconv.Itoa(row.EffectiveDistance),
+		strconv.Itoa(row.Flags),
+		strconv.FormatBool(row.TimelySource),
+		strconv.FormatBool(row.TimelyTarget),
+		strconv.FormatBool(row.TimelyHead),
+		row.ValidatorStatus,
+	})
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLWriter(out io.Writer) *jsonlWriter {
+	w := bufio.NewWriter(out)
+	return &jsonlWriter{w, json.NewEncoder(w)}
+}
+
+func (j *jsonlWriter) Write(row *Row) error {
+	return j.enc.Encode(row) // one object per line
+}
+
+func (j *jsonlWriter) Close() error {
+	return j.w.Flush()
+}
+
+func newRowWriter(format string, out io.Writer) (rowWriter, error) {
+	switch format {
+	case config.FormatCSV:
+		return newCSVWriter(out)
+	case config.FormatJSONL:
+		return newJSONLWriter(out), nil
+	case config.FormatParquet:
+		return newParquetWriter(out)
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// Pass every row of the duties we stored (see RegisterEpochDuties()) that
+// matches `f` to `fn`, ordered by epoch and then by validator index
+func queryDuties(storage db.Storage, f *db.ActivityFilter, fn func(db.ActivityRow) error) error {
+	epochs, err := storage.DutyEpochs(f)
+	if err != nil {
+		return err
+	}
+
+	for _, epoch := range epochs {
+		rows, err := storage.EpochDuties(epoch)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if !f.Matches(row) {
+				continue
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Export the rows of `storage` picked by `ecfg`, in the format and to the
+// output of `ecfg`. Returns the number of rows exported. If the export fails,
+// the output file is removed.
+func Export(storage db.Storage, ecfg *config.ExportConfig) (int, error) {
+	if ecfg.Output == "-" {
+		return export(storage, ecfg, os.Stdout)
+	}
+
+	f, err := os.Create(ecfg.Output)
+	if err != nil {
+		return 0, err
+	}
+	n, err := export(storage, ecfg, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(ecfg.Output)
+	}
+	return n, err
+}
+
+func export(storage db.Storage, ecfg *config.ExportConfig, out io.Writer) (int, error) {
+	w, err := newRowWriter(ecfg.Format, out)
+	if err != nil {
+		return 0, err
+	}
+
+	filter := &db.ActivityFilter{
+		FromEpoch:  ecfg.FromEpoch,
+		ToEpoch:    ecfg.ToEpoch,
+		Validators: ecfg.Validators,
+		Status:     ecfg.Status,
+	}
+
+	var n int
+	write := func(r db.ActivityRow) error {
+		n++
+		return w.Write(newRow(r))
+	}
+
+	if ecfg.Source == config.ExportDuties {
+		err = queryDuties(storage, filter, write)
+	} else {
+		err = storage.QueryActivity(filter, write)
+	}
+	if err != nil {
+		w.Close()
+		return n, err
+	}
+	return n, w.Close()
+}
@@ -0,0 +1,212 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/asn-d6/visit/config"
+	"github.com/asn-d6/visit/db"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// Run `fn` and return what it wrote to stdout
+func captureStdout(t *testing.T, fn func()) []byte {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestExportToStdoutFromFreshDatabase(t *testing.T) {
+	var n int
+	var exportErr error
+	out := captureStdout(t, func() {
+		// Opening a new database migrates it all the way
+		database, err := db.InitDatabase(filepath.Join(t.TempDir(), "visit.db"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer database.Close()
+		if err := database.RegisterAttestations([]db.ActivityRow{{ValidatorIdx: 7, Epoch: 3, Distance: 2, EffectiveDistance: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		n, exportErr = Export(database, &config.ExportConfig{Format: config.FormatJSONL, Output: "-", Source: config.ExportState, FromEpoch: -1, ToEpoch: -1})
+	})
+	if exportErr != nil || n != 1 {
+		t.Fatalf("exported %d rows (%v), expected one", n, exportErr)
+	}
+
+	// Nothing but the rows goes to stdout
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	var rows []Row
+	for scanner.Scan() {
+		var row Row
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("%q is not a row: %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 || rows[0].ValidatorIdx != 7 || rows[0].Status != db.StatusPerfect {
+		t.Errorf("got rows %+v", rows)
+	}
+}
+
+var testActivityRows = []db.ActivityRow{
+	{ValidatorIdx: 1, Epoch: 3, Distance: 1, EffectiveDistance: 1, Flags: 7},
+	{ValidatorIdx: 2, Epoch: 3, Distance: 3, EffectiveDistance: 1, Flags: db.FlagTimelySource | db.FlagTimelyTarget},
+	{ValidatorIdx: 2, Epoch: 4, Distance: db.MissingDistance, EffectiveDistance: db.MissingDistance, ValidatorStatus: db.StatusActiveOngoing},
+	{ValidatorIdx: 3, Epoch: 4, Distance: db.MissingDistance, EffectiveDistance: db.MissingDistance, ValidatorStatus: "exited_unslashed"},
+	{ValidatorIdx: 1, Epoch: 5, Distance: 4, EffectiveDistance: 3, Flags: db.FlagTimelySource},
+}
+
+// A fresh database with testActivityRows, and the duties of epoch 4
+func testExportDatabase(t *testing.T) *db.Database {
+	database, err := db.InitDatabase(filepath.Join(t.TempDir(), "visit.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.RegisterAttestations(testActivityRows); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.RegisterEpochDuties(4, testActivityRows[2:4]); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+// Read back the rows of a CSV export
+func readCSV(t *testing.T, data []byte) []Row {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []Row
+	for _, record := range records[1:] {
+		atoi := func(i int) int {
+			n, err := strconv.Atoi(record[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		parseBool := func(i int) bool {
+			b, err := strconv.ParseBool(record[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		rows = append(rows, Row{ValidatorIdx: atoi(0), Epoch: atoi(1), Distance: atoi(2), Status: record[3],
+			EffectiveDistance: atoi(4), Flags: atoi(5), TimelySource: parseBool(6), TimelyTarget: parseBool(7),
+			TimelyHead: parseBool(8), ValidatorStatus: record[9]})
+	}
+	return rows
+}
+
+// Read back the rows of a JSON Lines export
+func readJSONL(t *testing.T, data []byte) []Row {
+	var rows []Row
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var row Row
+		if err := dec.Decode(&row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Read back the rows of a Parquet export
+func readParquet(t *testing.T, data []byte) []Row {
+	file, err := buffer.NewBufferFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetReader(file, new(parquetRow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	stored := make([]parquetRow, pr.GetNumRows())
+	if err := pr.Read(&stored); err != nil {
+		t.Fatal(err)
+	}
+	var rows []Row
+	for _, r := range stored {
+		rows = append(rows, Row{ValidatorIdx: int(r.ValidatorIdx), Epoch: int(r.Epoch), Distance: int(r.Distance),
+			Status: r.Status, EffectiveDistance: int(r.EffectiveDistance), Flags: int(r.Flags), TimelySource: r.TimelySource,
+			TimelyTarget: r.TimelyTarget, TimelyHead: r.TimelyHead, ValidatorStatus: r.ValidatorStatus})
+	}
+	return rows
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	database := testExportDatabase(t)
+	readers := map[string]func(*testing.T, []byte) []Row{
+		config.FormatCSV:     readCSV,
+		config.FormatJSONL:   readJSONL,
+		config.FormatParquet: readParquet,
+	}
+
+	for _, test := range []struct {
+		name     string
+		ecfg     config.ExportConfig
+		expected []db.ActivityRow
+	}{
+		{"all", config.ExportConfig{FromEpoch: -1, ToEpoch: -1}, testActivityRows},
+		{"epochs", config.ExportConfig{FromEpoch: 4, ToEpoch: 5}, testActivityRows[2:]},
+		{"validators", config.ExportConfig{FromEpoch: -1, ToEpoch: -1, Validators: []int{1, 3}},
+			[]db.ActivityRow{testActivityRows[0], testActivityRows[3], testActivityRows[4]}},
+		{"missing", config.ExportConfig{FromEpoch: -1, ToEpoch: -1, Status: db.StatusMissing}, testActivityRows[2:3]},
+		{"inactive", config.ExportConfig{FromEpoch: -1, ToEpoch: -1, Status: db.StatusInactive}, testActivityRows[3:4]},
+		{"slow", config.ExportConfig{FromEpoch: 3, ToEpoch: -1, Status: db.StatusSlow}, testActivityRows[4:]},
+		{"nothing", config.ExportConfig{FromEpoch: 6, ToEpoch: -1}, nil},
+		// The duties don't know the validator statuses
+		{"duties", config.ExportConfig{Source: config.ExportDuties, FromEpoch: -1, ToEpoch: -1, Status: db.StatusMissing},
+			[]db.ActivityRow{{ValidatorIdx: 2, Epoch: 4, Distance: db.MissingDistance, EffectiveDistance: db.MissingDistance},
+				{ValidatorIdx: 3, Epoch: 4, Distance: db.MissingDistance, EffectiveDistance: db.MissingDistance}}},
+	} {
+		var expected []Row
+		for _, r := range test.expected {
+			expected = append(expected, *newRow(r))
+		}
+
+		for format, read := range readers {
+			ecfg := test.ecfg
+			ecfg.Format = format
+			var out bytes.Buffer
+			n, err := export(database, &ecfg, &out)
+			if err != nil {
+				t.Fatalf("%s export of %s: %v", format, test.name, err)
+			}
+			rows := read(t, out.Bytes())
+			if n != len(expected) || !reflect.DeepEqual(rows, expected) {
+				t.Errorf("%s export of %s: got %d rows %+v, expected %+v", format, test.name, n, rows, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package export
+
+import (
+	"io"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Row, as laid out in Parquet
+type parquetRow struct {
+	ValidatorIdx      int64  `parquet:"name=validator_idx, type=INT64"`
+	Epoch             int64  `parquet:"name=epoch, type=INT64"`
+	Distance          int32  `parquet:"name=distance, type=INT32"`
+	Status            string `parquet:"name=status, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	EffectiveDistance int32  `parquet:"name=effective_distance, type=INT32"`
+	Flags             int32  `parquet:"name=flags, type=INT32"`
+	TimelySource      bool   `parquet:"name=timely_source, type=BOOLEAN"`
+	TimelyTarget      bool   `parquet:"name=timely_target, type=BOOLEAN"`
+	TimelyHead        bool   `parquet:"name=timely_head, type=BOOLEAN"`
+	ValidatorStatus   string `parquet:"name=validator_status, type=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+type parquetWriter struct {
+	w *writer.ParquetWriter
+}
+
+func newParquetWriter(out io.Writer) (*parquetWriter, error) {
+	w, err := writer.NewParquetWriterFromWriter(out, new(parquetRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	w.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{w}, nil
+}
+
+func (p *parquetWriter) Write(row *Row) error {
+	return p.w.Write(parquetRow{
+		ValidatorIdx:      int64(row.ValidatorIdx),
+		Epoch:             int64(row.Epoch),
+		Distance:          int32(row.Distance),
+		Status:            row.Status,
+		EffectiveDistance: int32(row.EffectiveDistance),
+		Flags:             int32(row.Flags),
+		TimelySource:      row.TimelySource,
+		TimelyTarget:      row.TimelyTarget,
+		TimelyHead:        row.TimelyHead,
+		ValidatorStatus:   row.ValidatorStatus,
+	})
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.WriteStop()
+}
@@ -1,11 +1,15 @@
 module github.com/asn-d6/visit
 
-go 1.15
+go 1.16
 
 require (
+	github.com/lib/pq v1.10.2
 	github.com/mattn/go-sqlite3 v1.14.8
+	github.com/prometheus/client_golang v1.11.0
 	github.com/protolambda/eth2api v0.0.0-20210903181825-6d2901b54651
 	github.com/protolambda/zrnt v0.19.0
+	github.com/xitongsys/parquet-go v1.5.5-0.20201110004701-b09c49d6d457
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 replace github.com/protolambda/eth2api => ../eth2api
@@ -3,120 +3,424 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/asn-d6/visit/config"
+	"github.com/asn-d6/visit/db"
 	"github.com/asn-d6/visit/eth2_handler"
+	"github.com/asn-d6/visit/export"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/asn-d6/visit/server"
 	"github.com/asn-d6/visit/trackers"
-
-	_ "github.com/mattn/go-sqlite3"
-)
-
-const (
-	// How many slots should we monitor before aborting experiment?
-	EXPERIMENT_DURATION_BLOCKS = 330
-
-	// How many seconds we should wait before fetching a new block
-	FETCH_BLOCK_SECONDS = 12
-
-	// How many times we should try fetching a specific block before we give up
-	SAME_BLOCK_RETRIES = 3
+	"github.com/protolambda/zrnt/eth2/beacon/common"
 )
 
 // Singleton that holds a bunch of state for our program
 // XXX pretty useless atm
 type Visit struct {
+	// Run parameters (see the config module)
+	cfg *config.Config
+
 	// State required by eth2api to work
 	eth2Handler *eth2_handler.Eth2Handler
 
-	// Next slot to fech (we explicitly request specific block numbers
-	// incrementally so that we don't miss any (if we are fetching too slow),
-	// or continuously fetch the same one (if we are fetching too fast).
+	// Where the results go
+	database db.Storage
+
+	// Next slot to fetch. We follow the slot clock and explicitly request
+	// every slot, so that we can tell a missed proposal apart from a block
+	// that we simply asked for too early.
 	nextSlotToFetch int
-}
 
-var fetchBlockTimer *time.Ticker
+	// How many blocks we have processed so far
+	blocksProcessed uint
 
-func lets_wrap_up() {
+	// Did we resume from a checkpoint? If so, `nextSlotToFetch` comes from
+	// there instead of the slot clock.
+	resumed bool
+}
+
+func (m *Visit) lets_wrap_up() {
 	fmt.Printf("***************** WRAPPING UP **********************\n")
-	if fetchBlockTimer != nil {
-		fetchBlockTimer.Stop()
+	// Checkpoint before dumping: the dump also writes epochs that are still
+	// within their inclusion window, which we want to keep on resuming
+	if err := trackers.SaveCheckpoint(m.eth2Handler.CommitteeTracker()); err != nil {
+		fmt.Printf("[!] Failed to save checkpoint: %v\n", err)
+	}
+	if err := trackers.DumpActivityTracker(); err != nil {
+		fmt.Printf("[!] Failed to dump the data: %v\n", err)
+		os.Exit(1)
+	}
+	if err := m.database.Close(); err != nil {
+		fmt.Printf("[!] %v\n", err)
+		os.Exit(1)
 	}
-	trackers.DumpActivityTracker()
 	os.Exit(0)
 }
 
-func (m *Visit) do_the_monitoring() {
-	retry_counter := 0
-	fetchBlockTimer = time.NewTicker(FETCH_BLOCK_SECONDS * time.Second)
+// A block was just processed. If the experiment is done, dump the data, and
+// let's go home.
+func (m *Visit) block_processed() {
+	m.blocksProcessed++
+	if m.blocksProcessed >= m.cfg.ExperimentDurationBlocks {
+		m.lets_wrap_up()
+	}
+}
+
+// Start from the current slot, unless we are already past the point where we
+// should have fetched it. If we resumed from a checkpoint, first backfill the
+// slots we missed while we were away.
+func (m *Visit) start_from_current_slot() {
+	clock := m.eth2Handler.SlotClock()
+	if m.resumed {
+		fmt.Printf("[!] Backfilling from slot #%d up to the current slot\n", m.nextSlotToFetch)
+		for common.Slot(m.nextSlotToFetch) < clock.CurrentSlot() {
+			slot := common.Slot(m.nextSlotToFetch)
+			m.nextSlotToFetch++
+			if m.fetch_past_slot(slot) {
+				m.block_processed()
+			}
+		}
+		return
+	}
 
-	// Fetch the first block and mark its slot number
-	handledSlot := m.eth2Handler.FetchAndProcessBlock(0)
-	if handledSlot != 0 {
-		m.nextSlotToFetch = handledSlot + 1
+	fetchDelay := time.Duration(m.cfg.FetchDelaySeconds) * time.Second
+
+	m.nextSlotToFetch = int(clock.CurrentSlot())
+	if time.Now().After(clock.SlotStart(common.Slot(m.nextSlotToFetch)).Add(fetchDelay)) {
+		m.nextSlotToFetch++
 	}
+}
+
+// Wait for the next slot to fetch and process its block
+func (m *Visit) poll_next_slot() {
+	clock := m.eth2Handler.SlotClock()
+	fetchDelay := time.Duration(m.cfg.FetchDelaySeconds) * time.Second
+
+	// Wake up a few seconds into the slot and fetch exactly that slot.
+	// If we fell behind, this returns immediately and we catch up.
+	slot := common.Slot(m.nextSlotToFetch)
+	clock.SleepUntil(slot, fetchDelay)
+
+	m.nextSlotToFetch++
+	if m.fetch_slot(slot) {
+		m.block_processed()
+	}
+}
+
+// Fetch and process the block of `slot`. If it's not there yet, keep retrying
+// until the moment we would fetch the next slot: if the block still hasn't
+// shown up by then, the proposer missed its slot.
+//
+// Return true if the block was fetched and handled.
+func (m *Visit) fetch_slot(slot common.Slot) bool {
+	clock := m.eth2Handler.SlotClock()
+	fetchDelay := time.Duration(m.cfg.FetchDelaySeconds) * time.Second
+	deadline := clock.SlotStart(slot + 1).Add(fetchDelay)
+	retryInterval := clock.SlotDuration() / time.Duration(m.cfg.SameBlockRetries+1)
 
-	// Now incrementally fetch and process the next blocks
-	var i uint = 1
 	for {
-		select {
-		case <-fetchBlockTimer.C:
-			// If experiment is done, dump the data, and let's go home
-			if i >= EXPERIMENT_DURATION_BLOCKS {
-				lets_wrap_up()
-			}
+		_, err := m.eth2Handler.FetchAndProcessBlock(int(slot))
+		if err == nil {
+			return true
+		}
+
+		// A block that's not there yet is expected. Anything else goes
+		// through the error policy.
+		if !is_empty_slot(err) && m.handle_error(err, slot) == actionSkip {
+			return false
+		}
+
+		// Too early? Give the block some more time to propagate (retries
+		// because of other errors are counted by the error policy)
+		if is_empty_slot(err) {
+			metrics.FetchRetries.Inc()
+		}
+		if time.Now().Add(retryInterval).Before(deadline) {
+			time.Sleep(retryInterval)
+			continue
+		}
+
+		// Our last attempt happens at the deadline
+		time.Sleep(time.Until(deadline))
+		_, err = m.eth2Handler.FetchAndProcessBlock(int(slot))
+		if err == nil {
+			return true
+		}
+
+		if is_empty_slot(err) {
+			fmt.Printf("[!] No block for slot #%d: proposal was missed\n", slot)
+			metrics.SkippedSlots.WithLabelValues("missed").Inc()
+			m.eth2Handler.HandleEmptySlot(slot)
+		} else {
+			fmt.Printf("[!] Giving up on slot #%d: %v\n", slot, err)
+			metrics.SkippedSlots.WithLabelValues("error").Inc()
+		}
+		return false
+	}
+}
+
+// Fetch and process the block of a `slot` that's in the past, so that a
+// missing block means an empty slot.
+//
+// Return true if the block was fetched and handled.
+func (m *Visit) fetch_past_slot(slot common.Slot) bool {
+	clock := m.eth2Handler.SlotClock()
+	retryInterval := clock.SlotDuration() / time.Duration(m.cfg.SameBlockRetries+1)
+	retry_counter := 0
+	for {
+		_, err := m.eth2Handler.FetchAndProcessBlock(int(slot))
+		if err == nil {
+			return true
+		}
 
-			// Fetch the block and handle it (with retries if needed)
-			handledSlot = m.eth2Handler.FetchAndProcessBlock(m.nextSlotToFetch)
-			if handledSlot == 0 || handledSlot != m.nextSlotToFetch {
-				// fetch failed (either 404 or wrong block returned): check if we should retry
-				retry_counter++
-				if retry_counter >= SAME_BLOCK_RETRIES {
-					// We've tried too many times for the same block: give up
-					fmt.Printf("[!] Giving up on slot #%d\n", m.nextSlotToFetch)
-					m.nextSlotToFetch++
-					retry_counter = 0
-				}
-			} else { // fetch success! let's move on
-				m.nextSlotToFetch = handledSlot + 1
-				retry_counter = 0
-				i++
+		if is_empty_slot(err) {
+			// Past blocks don't appear out of nowhere: a missing block is an
+			// empty slot. Only within a slot of the head, give the node a few
+			// chances to catch up.
+			retry_counter++
+			if slot+1 < clock.CurrentSlot() || retry_counter >= m.cfg.SameBlockRetries {
+				fmt.Printf("[!] No block for slot #%d\n", slot)
+				metrics.SkippedSlots.WithLabelValues("missed").Inc()
+				m.eth2Handler.HandleEmptySlot(slot)
+				return false
 			}
+			metrics.FetchRetries.Inc()
+			time.Sleep(retryInterval)
+			continue
 		}
+
+		if m.handle_error(err, slot) == actionSkip {
+			return false
+		}
+	}
+}
+
+func (m *Visit) do_the_monitoring() {
+	m.start_from_current_slot()
+
+	for {
+		m.poll_next_slot()
 	}
 }
 
-func initialize_visit() *Visit {
+// Restore the trackers from the last checkpoint in the database, if any
+func (m *Visit) resume_from_checkpoint() {
+	cp, err := m.database.LoadCheckpoint()
+	if err != nil {
+		fmt.Println("failed to load checkpoint", err)
+		os.Exit(1)
+	}
+	if cp == nil {
+		fmt.Println("[!] No checkpoint to resume from. Starting fresh.")
+		return
+	}
+
+	trackers.RestoreCheckpoint(m.eth2Handler.CommitteeTracker(), cp)
+	m.nextSlotToFetch = cp.LastSlot + 1
+	m.resumed = true
+}
+
+// Process all the blocks of the configured epoch range as fast as the node
+// allows, and then wrap up
+func (m *Visit) do_the_backfill() {
+	startEpoch := common.Epoch(m.cfg.BackfillStartEpoch)
+	endEpoch := common.Epoch(m.cfg.BackfillEndEpoch)
+	fmt.Printf("[!] Backfilling epochs #%d to #%d\n", startEpoch, endEpoch)
+
+	// Attestations for the last epoch can be included up to the end of the
+	// epoch after it, so go through that one as well
+	firstSlot := trackers.ComputeStartSlotAtEpoch(startEpoch)
+	lastSlot := trackers.ComputeStartSlotAtEpoch(endEpoch+2) - 1
+
+	// We go through every slot of the range, so its first epoch is fully seen
+	// even if its first slots are empty
+	trackers.StartFromSlot(firstSlot)
+
+	// Slot zero is the genesis block and has no attestations (also, asking
+	// for block zero means asking for the head)
+	if firstSlot == 0 {
+		firstSlot = 1
+	}
+
+	for slot := firstSlot; slot <= lastSlot; slot++ {
+		m.fetch_past_slot(slot)
+	}
+
+	m.lets_wrap_up()
+}
+
+// Open the database picked in `cfg`, or die trying
+func open_database(cfg *config.Config) db.Storage {
+	var database *db.Database
+	var err error
+	if cfg.DatabaseBackend == config.DatabasePostgres {
+		database, err = db.InitPostgres(cfg.DatabaseURL, cfg.DatabaseBatchSize)
+	} else {
+		database, err = db.InitDatabase(cfg.DatabasePath, cfg.DatabaseBatchSize)
+	}
+	if err != nil {
+		fmt.Println("failed to open database", err)
+		os.Exit(1)
+	}
+	database.SetCollector(cfg.CollectorID)
+	return database
+}
+
+// Open the stream that slashing alerts get appended to ("-" for stdout, nil
+// if `path` is empty)
+func open_slashing_alerts(path string) io.Writer {
+	if path == "" {
+		return nil
+	}
+	if path == "-" {
+		return os.Stdout
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("failed to open slashing alerts file", err)
+		os.Exit(1)
+	}
+	return f
+}
+
+func initialize_visit(cfg *config.Config) *Visit {
 	fmt.Println("[!] Initializing visit")
 
-	eth2Handler := eth2_handler.InitEth2Handler()
+	eth2Handler := eth2_handler.InitEth2Handler(cfg)
+	if slotDuration := eth2Handler.SlotClock().SlotDuration(); time.Duration(cfg.FetchDelaySeconds)*time.Second >= slotDuration {
+		fmt.Printf("fetch delay of %ds does not fit in a slot of %v\n", cfg.FetchDelaySeconds, slotDuration)
+		os.Exit(1)
+	}
+
+	database := open_database(cfg)
+	watchlist := cfg.Watchlist
+	if cfg.WatchlistFile != "" {
+		fromFile, err := eth2Handler.LoadWatchlist(cfg.WatchlistFile)
+		if err != nil {
+			fmt.Println("failed to load watchlist", err)
+			os.Exit(1)
+		}
+		watchlist = append(watchlist, fromFile...)
+	}
+	trackers.InitWatchlist(watchlist)
+
+	filter, err := trackers.NewStorageFilter(cfg.StorageFilter, watchlist)
+	if err != nil {
+		fmt.Println("failed to set up storage filter", err)
+		os.Exit(1)
+	}
+	trackers.InitActivityTracker(database, cfg.Resume && !cfg.IsBackfill(), filter, cfg.StoreAllDuties)
+	if cfg.TrackStatuses {
+		trackers.InitLifecycleTracker(eth2Handler)
+	}
+	if cfg.TrackRewards {
+		trackers.InitRewardTracker(eth2Handler)
+	}
+	if cfg.DetectSlashings {
+		trackers.InitSlashingObserver(cfg.SlashingHistoryEpochs, open_slashing_alerts(cfg.SlashingAlerts))
+	}
+
+	if cfg.MetricsAddr != "" {
+		metrics.Serve(cfg.MetricsAddr)
+	}
+
+	visit := Visit{
+		cfg:         cfg,
+		eth2Handler: eth2Handler,
+		database:    database,
+	}
+
+	if cfg.Resume && !cfg.IsBackfill() {
+		visit.resume_from_checkpoint()
+	}
 
 	// Setup a sighandler
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		lets_wrap_up()
+		visit.lets_wrap_up()
 		os.Exit(1)
 	}()
 
-	visit := Visit{
-		eth2Handler: eth2Handler,
-	}
 	return &visit
 }
 
+// Write the data we collected to a file (`visit export`)
+func do_the_export(args []string) {
+	ecfg, err := config.LoadExportConfig(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Println("Wrong usage!", err)
+		os.Exit(1)
+	}
+
+	database := open_database(ecfg.Config)
+	defer database.Close()
+
+	n, err := export.Export(database, ecfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[!] Export failed:", err)
+		database.Close()
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "[*] Exported %d rows\n", n)
+}
+
+// Serve the visualization and its API (`visit serve`)
+func do_the_serving(args []string) {
+	scfg, err := config.LoadServeConfig(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Println("Wrong usage!", err)
+		os.Exit(1)
+	}
+
+	database := open_database(scfg.Config)
+	defer database.Close()
+
+	if err := server.InitServer(database).ListenAndServe(scfg.ListenAddr); err != nil {
+		fmt.Println("[!] Server failed:", err)
+		database.Close()
+		os.Exit(1)
+	}
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Wrong usage! Try:\n\t./visit <ip:port>")
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		do_the_export(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		do_the_serving(os.Args[2:])
+		return
+	}
+
+	cfg, err := config.LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Println("Wrong usage!", err)
 		os.Exit(1)
 	}
 
 	// Initialize the singleton thing that does everything
-	visit := initialize_visit()
+	visit := initialize_visit(cfg)
 
-	visit.do_the_monitoring()
+	if cfg.IsBackfill() {
+		visit.do_the_backfill()
+	} else if cfg.IngestionMode == config.IngestionEvents {
+		visit.do_the_event_ingestion()
+	} else {
+		visit.do_the_monitoring()
+	}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asn-d6/visit/config"
+	"github.com/asn-d6/visit/eth2_handler"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// A visit following a node that has no block at any slot, on a mainnet chain
+// that started `slots` slots ago
+func testEmptyChainVisit(t *testing.T, slots int) *Visit {
+	genesis := time.Now().Add(-time.Duration(slots) * 12 * time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth/v1/beacon/genesis" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"data": {"genesis_time": "%d", "genesis_validators_root": "0x%064x", "genesis_fork_version": "0x00000000"}}`,
+			genesis.Unix(), 0)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg, err := config.LoadConfig([]string{"-beacon-addr", strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Visit{cfg: cfg, eth2Handler: eth2_handler.InitEth2Handler(cfg)}
+}
+
+func TestFetchPastEmptySlotDoesNotWait(t *testing.T) {
+	m := testEmptyChainVisit(t, 1000)
+
+	// Going through old empty slots (as backfills do) takes no retries
+	start := time.Now()
+	for slot := common.Slot(100); slot < 110; slot++ {
+		if m.fetch_past_slot(slot) {
+			t.Fatalf("got a block for empty slot #%d", slot)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("going through 10 empty slots took %s", elapsed)
+	}
+}
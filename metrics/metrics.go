@@ -0,0 +1,148 @@
+/// This module keeps the Prometheus metrics of visit: how the collector is
+/// doing, and what the trackers see on the chain. They are served on /metrics
+/// if a metrics address is configured.
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Collector health
+var (
+	BlocksFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "visit_blocks_fetched_total",
+		Help: "Blocks fetched and processed",
+	})
+
+	FetchRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "visit_fetch_retries_total",
+		Help: "Times we asked the node for a block again",
+	})
+
+	// reason is "missed" (no block in the slot) or "error" (we gave up)
+	SkippedSlots = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "visit_skipped_slots_total",
+		Help: "Slots we could not process a block for",
+	}, []string{"reason"})
+
+	APIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "visit_api_request_duration_seconds",
+		Help:    "Latency of beacon node API requests",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	CommitteeCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_committee_cache_size",
+		Help: "Committees currently tracked",
+	})
+
+	DBWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "visit_db_write_duration_seconds",
+		Help:    "Latency of database writes",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+)
+
+// What we see on the chain, as of the last epoch we flushed
+var (
+	LastFlushedEpoch = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_last_flushed_epoch",
+		Help: "Last epoch written to the database",
+	})
+
+	EpochParticipationRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_epoch_participation_rate",
+		Help: "Fraction of the active validators with a duty in the last flushed epoch that got included",
+	})
+
+	EpochMissingValidators = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_epoch_missing_validators",
+		Help: "Active validators that never got included in the last flushed epoch",
+	})
+
+	EpochInactiveValidators = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_epoch_inactive_validators",
+		Help: "Validators that never got included in the last flushed epoch, but were exiting, exited or slashed",
+	})
+
+	EpochSlowValidators = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_epoch_slow_validators",
+		Help: "Validators included with an effective inclusion distance above 1 in the last flushed epoch",
+	})
+
+	Reorgs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "visit_reorgs_total",
+		Help: "Chain reorganizations that made us roll back blocks",
+	})
+
+	EpochSyncParticipationRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "visit_epoch_sync_participation_rate",
+		Help: "Fraction of sync committee signatures that made it into the blocks of the last flushed epoch",
+	})
+
+	InclusionDistance = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "visit_inclusion_distance",
+		Help:    "Inclusion distance of the validators of every flushed epoch (missing validators are not counted)",
+		Buckets: []float64{1, 2, 3, 4, 5, 6, 8, 12, 16, 24, 32, 48, 64},
+	})
+
+	EffectiveInclusionDistance = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "visit_effective_inclusion_distance",
+		Help:    "Inclusion distance of the validators of every flushed epoch, not counting empty slots",
+		Buckets: []float64{1, 2, 3, 4, 5, 6, 8, 12, 16, 24, 32, 48, 64},
+	})
+
+	Proposals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "visit_proposals_total",
+		Help: "Block proposals we saw, by what happened to them (orphaned blocks were counted as proposed first)",
+	}, []string{"status"})
+
+	LifecycleEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "visit_lifecycle_events_total",
+		Help: "Deposits, voluntary exits and slashings found in the blocks we processed",
+	}, []string{"kind"})
+
+	SlashableVotes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "visit_slashable_votes_total",
+		Help: "Slashable attestations we saw on chain, by kind (double or surround vote)",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		BlocksFetched, FetchRetries, SkippedSlots, APIRequestDuration, CommitteeCacheSize, DBWriteDuration,
+		LastFlushedEpoch, EpochParticipationRate, EpochMissingValidators, EpochSlowValidators, InclusionDistance,
+		EffectiveInclusionDistance, Proposals, EpochSyncParticipationRate, Reorgs, EpochInactiveValidators,
+		LifecycleEvents, SlashableVotes,
+	)
+}
+
+// Start timing a request to `endpoint` of the node. Call ObserveDuration() on
+// the result once it's done.
+func TimeAPIRequest(endpoint string) *prometheus.Timer {
+	return prometheus.NewTimer(APIRequestDuration.WithLabelValues(endpoint))
+}
+
+// Start timing the database write `op`. Call ObserveDuration() on the result
+// once it's done.
+func TimeDBWrite(op string) *prometheus.Timer {
+	return prometheus.NewTimer(DBWriteDuration.WithLabelValues(op))
+}
+
+// Serve /metrics on `addr` in the background
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	fmt.Printf("[!] Serving metrics on http://%s/metrics\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("[!] Metrics server failed: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,237 @@
+/// This module serves the swimlane visualization, along with a JSON API that
+/// the visualization queries to page through the database live.
+///
+/// API (every endpoint answers with JSON):
+///   GET /api/validators?offset=&limit=
+///       validators we have data for, ordered by index
+///   GET /api/epochs
+///       epochs we have data for, in order
+///   GET /api/activity?offset=&limit=&validators=&from_epoch=&to_epoch=&status=
+///       the rows of a page of validators (or of the given validators)
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/visualize_d3"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type Server struct {
+	storage db.Storage
+}
+
+// A validator_state row, as served
+type activityRow struct {
+	ValidatorIdx int    `json:"validator_idx"`
+	Epoch        int    `json:"epoch"`
+	Distance     int    `json:"distance"`
+	Status       string `json:"status"`
+	Flags        int    `json:"flags"`
+
+	// Inclusion distance not counting empty slots (what Status is based on)
+	EffectiveDistance int `json:"effective_distance"`
+
+	// Status of missing validators according to the beacon node, if known
+	ValidatorStatus string `json:"validator_status,omitempty"`
+}
+
+type validatorsResponse struct {
+	Total      int   `json:"total"`
+	Offset     int   `json:"offset"`
+	Limit      int   `json:"limit"`
+	Validators []int `json:"validators"`
+}
+
+type epochsResponse struct {
+	Epochs []int `json:"epochs"`
+}
+
+type activityResponse struct {
+	// Total number of validators we could page through
+	TotalValidators int `json:"total_validators"`
+	Offset          int `json:"offset"`
+	Limit           int `json:"limit"`
+
+	// The validators of this page, and their rows
+	Validators []int         `json:"validators"`
+	Rows       []activityRow `json:"rows"`
+}
+
+// A bad request: the message goes back to the client
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func InitServer(storage db.Storage) *Server {
+	return &Server{storage: storage}
+}
+
+// Return the handler serving the visualization and the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/validators", apiHandler(s.handleValidators))
+	mux.Handle("/api/epochs", apiHandler(s.handleEpochs))
+	mux.Handle("/api/activity", apiHandler(s.handleActivity))
+	mux.Handle("/", http.FileServer(http.FS(visualize_d3.Assets)))
+	return mux
+}
+
+// Serve the visualization and the API on `addr` until something goes wrong
+func (s *Server) ListenAndServe(addr string) error {
+	fmt.Printf("[!] Serving the visualization on http://%s/\n", addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// An API endpoint. Returns the response to encode as JSON.
+type apiHandler func(r *http.Request) (interface{}, error)
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is supported"})
+		return
+	}
+
+	resp, err := h(r)
+	if _, ok := err.(*requestError); ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		fmt.Printf("[!] Failed to serve %s: %v\n", r.URL, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Return the integer query parameter `name` of `r`, or `def` if it's not there
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, &requestError{fmt.Sprintf("invalid %s: %q", name, value)}
+	}
+	return i, nil
+}
+
+// Return the offset and limit of the page `r` asks for
+func pageParams(r *http.Request) (int, int, error) {
+	offset, err := intParam(r, "offset", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := intParam(r, "limit", defaultPageSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit == 0 || limit > maxPageSize {
+		return 0, 0, &requestError{fmt.Sprintf("limit must be between 1 and %d", maxPageSize)}
+	}
+	return offset, limit, nil
+}
+
+func (s *Server) handleValidators(r *http.Request) (interface{}, error) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	validators, total, err := s.storage.ValidatorPage(offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &validatorsResponse{Total: total, Offset: offset, Limit: limit, Validators: validators}, nil
+}
+
+func (s *Server) handleEpochs(r *http.Request) (interface{}, error) {
+	epochs, err := s.storage.Epochs()
+	if err != nil {
+		return nil, err
+	}
+	return &epochsResponse{Epochs: epochs}, nil
+}
+
+func (s *Server) handleActivity(r *http.Request) (interface{}, error) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &db.ActivityFilter{}
+	if filter.FromEpoch, err = intParam(r, "from_epoch", -1); err != nil {
+		return nil, err
+	}
+	if filter.ToEpoch, err = intParam(r, "to_epoch", -1); err != nil {
+		return nil, err
+	}
+	switch status := r.URL.Query().Get("status"); status {
+	case "", db.StatusPerfect, db.StatusSlow, db.StatusMissing, db.StatusInactive:
+		filter.Status = status
+	default:
+		return nil, &requestError{fmt.Sprintf("invalid status: %q", status)}
+	}
+
+	resp := &activityResponse{Offset: offset, Limit: limit, Rows: []activityRow{}}
+	if list := r.URL.Query().Get("validators"); list != "" {
+		for _, part := range strings.Split(list, ",") {
+			validator, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || validator < 0 {
+				return nil, &requestError{fmt.Sprintf("invalid validator: %q", part)}
+			}
+			resp.Validators = append(resp.Validators, validator)
+		}
+		if len(resp.Validators) > maxPageSize {
+			return nil, &requestError{fmt.Sprintf("at most %d validators at a time", maxPageSize)}
+		}
+		resp.TotalValidators = len(resp.Validators)
+	} else {
+		resp.Validators, resp.TotalValidators, err = s.storage.ValidatorPage(offset, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(resp.Validators) == 0 {
+		return resp, nil
+	}
+
+	filter.Validators = resp.Validators
+	err = s.storage.QueryActivity(filter, func(row db.ActivityRow) error {
+		resp.Rows = append(resp.Rows, activityRow{
+			ValidatorIdx:      row.ValidatorIdx,
+			Epoch:             row.Epoch,
+			Distance:          row.Distance,
+			Status:            db.DistanceStatus(row.EffectiveDistance, row.ValidatorStatus),
+			Flags:             row.Flags,
+			EffectiveDistance: row.EffectiveDistance,
+			ValidatorStatus:   row.ValidatorStatus,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
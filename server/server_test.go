@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+)
+
+// A server on a database with validators 1 to 5 over epochs 3 and 4. In
+// epoch 4, validator 2 was missing and validator 4 slow.
+func testServer(t *testing.T) *httptest.Server {
+	database, err := db.InitDatabase(filepath.Join(t.TempDir(), "visit.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	var rows []db.ActivityRow
+	for epoch := 3; epoch <= 4; epoch++ {
+		for validator := 1; validator <= 5; validator++ {
+			row := db.ActivityRow{ValidatorIdx: validator, Epoch: epoch, Distance: 1, EffectiveDistance: 1}
+			if epoch == 4 && validator == 2 {
+				row.Distance, row.EffectiveDistance = db.MissingDistance, db.MissingDistance
+			} else if epoch == 4 && validator == 4 {
+				row.Distance, row.EffectiveDistance = 3, 3
+			}
+			rows = append(rows, row)
+		}
+	}
+	if err := database.RegisterAttestations(rows); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(InitServer(database).Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// GET `path` from `srv`, and decode the response into `resp`. Returns the
+// status code.
+func get(t *testing.T, srv *httptest.Server, path string, resp interface{}) int {
+	r, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return r.StatusCode
+}
+
+func TestActivityPages(t *testing.T) {
+	srv := testServer(t)
+
+	for _, test := range []struct {
+		path       string
+		validators []int
+		rows       int
+	}{
+		{"/api/activity", []int{1, 2, 3, 4, 5}, 10},
+		{"/api/activity?offset=0&limit=2", []int{1, 2}, 4},
+		{"/api/activity?offset=2&limit=2", []int{3, 4}, 4},
+		{"/api/activity?offset=4&limit=2", []int{5}, 2},
+		{"/api/activity?offset=10&limit=2", []int{}, 0},
+		{"/api/activity?offset=0&limit=2&from_epoch=4", []int{1, 2}, 2},
+		{"/api/activity?offset=0&limit=5&to_epoch=3", []int{1, 2, 3, 4, 5}, 5},
+		{"/api/activity?validators=4,2&status=missing", []int{4, 2}, 1},
+		{"/api/activity?validators=4&status=slow", []int{4}, 1},
+	} {
+		var resp activityResponse
+		if status := get(t, srv, test.path, &resp); status != http.StatusOK {
+			t.Errorf("%s: got status %d", test.path, status)
+			continue
+		}
+		if !reflect.DeepEqual(resp.Validators, test.validators) || len(resp.Rows) != test.rows {
+			t.Errorf("%s: got validators %v and %d rows, expected %v and %d", test.path, resp.Validators, len(resp.Rows),
+				test.validators, test.rows)
+		}
+		for _, row := range resp.Rows {
+			if row.Epoch == 4 && row.ValidatorIdx == 2 && row.Status != db.StatusMissing {
+				t.Errorf("%s: validator 2 should be missing in epoch 4: %+v", test.path, row)
+			}
+		}
+	}
+
+	var resp activityResponse
+	get(t, srv, "/api/activity?offset=2&limit=2", &resp)
+	if resp.TotalValidators != 5 || resp.Offset != 2 || resp.Limit != 2 {
+		t.Errorf("wrong page: %+v", resp)
+	}
+}
+
+func TestActivityBadParameters(t *testing.T) {
+	srv := testServer(t)
+
+	for _, path := range []string{
+		"/api/activity?limit=0",
+		"/api/activity?limit=1001",
+		"/api/activity?offset=-1",
+		"/api/activity?offset=two",
+		"/api/activity?from_epoch=x",
+		"/api/activity?to_epoch=-5",
+		"/api/activity?status=late",
+		"/api/activity?validators=1,x",
+		"/api/activity?validators=-1",
+	} {
+		var resp map[string]string
+		if status := get(t, srv, path, &resp); status != http.StatusBadRequest || resp["error"] == "" {
+			t.Errorf("%s: got status %d and %v, expected a bad request", path, status, resp)
+		}
+	}
+
+	r, err := http.Post(srv.URL+"/api/activity", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %d", r.StatusCode)
+	}
+}
@@ -7,14 +7,23 @@ package trackers
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 )
 
 const (
 	// Magic number that signals a missing validator
-	VALIDATOR_MISSING_MAGIC = 65535
+	VALIDATOR_MISSING_MAGIC = db.MissingDistance
+)
+
+// Participation flags a validator can earn in an epoch (a bitfield)
+const (
+	TIMELY_SOURCE_FLAG = db.FlagTimelySource
+	TIMELY_TARGET_FLAG = db.FlagTimelyTarget
+	TIMELY_HEAD_FLAG   = db.FlagTimelyHead
 )
 
 // Tracks the activity of validators per epoch. Maps epochs to validators, and
@@ -31,25 +40,56 @@ const (
 // missing
 var validatorActivityTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
 
-// Tracks which validators are interesting for our analysis (only validators
-// that have been slow or missing are interesting to us... we are weird)
+// Tracks the effective inclusion distance of validators per epoch: the
+// inclusion distance minus the empty slots in between, since a validator can't
+// be included in a block that was never published. Same shape as
+// validatorActivityTracker.
+var validatorEffectiveTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+
+// Tracks the participation flags that validators earned per epoch. Same shape
+// as validatorActivityTracker. A validator earns the flags of every one of its
+// included attestations (usually there is just one, but it can also be
+// included more than once).
+var validatorFlagsTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+
+// Tracks which validators are interesting for our analysis, according to
+// storageFilter (by default only validators that have been slow or missing
+// are interesting to us... we are weird)
 //
-// XXX False positive: Inclusion distance can be high even in "normal"
-// circumstances if some blocks fail to get published, since the next block is
-// gonna include attestations about old blocks.
+// Filters look at the effective inclusion distance: if some blocks fail to get
+// published, the next block is gonna include attestations about old slots, but
+// that's not the fault of the validators.
 var interestingValidators = map[common.ValidatorIndex]bool{}
 
 var numInterestingValidators int
 
+func flagInteresting(valIndex common.ValidatorIndex) {
+	if !interestingValidators[valIndex] {
+		interestingValidators[valIndex] = true
+		numInterestingValidators++
+	}
+}
+
+func unflagInteresting(valIndex common.ValidatorIndex) {
+	if interestingValidators[valIndex] {
+		delete(interestingValidators, valIndex)
+		numInterestingValidators--
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////
 
 // We just learned about the presense of validator `index` from an attestation
 // to slot `attestationSlot` that was found in block `blockSlot`.
-// The validator was either present or not, depending on the value of `is_present`
+// The validator was either present or not, depending on the value of `is_present`.
+// If present, it earned the participation `flags` of the attestation.
 //
 // XXX eek this code smells horrible
-func registerValidatorPresense(valIndex common.ValidatorIndex, attestationSlot common.Slot, blockSlot common.Slot, is_present bool) {
+func registerValidatorPresense(valIndex common.ValidatorIndex, attestationSlot common.Slot, blockSlot common.Slot, is_present bool, flags int) {
 	epoch := ComputeEpochAtSlot(attestationSlot)
+	if epoch < forgottenBefore { // already flushed
+		return
+	}
 	if validatorActivityTracker[epoch] == nil { // initialize map if needed
 		validatorActivityTracker[epoch] = make(map[common.ValidatorIndex]int)
 	}
@@ -58,27 +98,35 @@ func registerValidatorPresense(valIndex common.ValidatorIndex, attestationSlot c
 	// validator is attesting for compared to the current block (max distance
 	// is 64 slots)
 	inclusion_distance := int(blockSlot - attestationSlot)
+	effective_distance := effectiveInclusionDistance(attestationSlot, blockSlot)
+
+	if validatorEffectiveTracker[epoch] == nil {
+		validatorEffectiveTracker[epoch] = make(map[common.ValidatorIndex]int)
+	}
 
 	if is_present {
+		if validatorFlagsTracker[epoch] == nil {
+			validatorFlagsTracker[epoch] = make(map[common.ValidatorIndex]int)
+		}
+		validatorFlagsTracker[epoch][valIndex] |= flags
+
 		// The inclusion distance shouldn't increase
 		if validatorActivityTracker[epoch][valIndex] != 0 && inclusion_distance >= validatorActivityTracker[epoch][valIndex] {
 			return
 		}
 
+		previous := validatorActivityTracker[epoch][valIndex]
 		validatorActivityTracker[epoch][valIndex] = inclusion_distance
+		validatorEffectiveTracker[epoch][valIndex] = effective_distance
 
-		if inclusion_distance > 1 { // flag slow validators as interesting
-			interestingValidators[valIndex] = true
-			numInterestingValidators++
-		}
-
-		// Validators with optimal inclusion distance could also be flagged as
-		// "interesting" if there are two attestations for the same slot in the
-		// block. The first one does not include them but the second one
-		// includes them. So deflag them here.
-		if inclusion_distance == 1 && interestingValidators[valIndex] {
-			interestingValidators[valIndex] = false
-			numInterestingValidators--
+		if storageFilter.IsInteresting(valIndex, effective_distance) {
+			flagInteresting(valIndex)
+		} else if previous == VALIDATOR_MISSING_MAGIC {
+			// Validators could also be flagged as "interesting" for missing
+			// if there are two attestations for the same slot in the block.
+			// The first one does not include them but the second one
+			// includes them. So deflag them here.
+			unflagInteresting(valIndex)
 		}
 //		fmt.Printf("\tValidator #%d distance: %d (cur block %d / att %d) (%d interesting)\n", valIndex, validatorActivityTracker[epoch][valIndex], blockSlot, attestationSlot, numInterestingValidators)
 	} else {
@@ -91,63 +139,275 @@ func registerValidatorPresense(valIndex common.ValidatorIndex, attestationSlot c
 //		fmt.Printf("\tValidator #%d marked as missing (%d interesting)\n", valIndex, numInterestingValidators)
 
 		validatorActivityTracker[epoch][valIndex] = VALIDATOR_MISSING_MAGIC
-		interestingValidators[valIndex] = true
-		numInterestingValidators++
+		validatorEffectiveTracker[epoch][valIndex] = VALIDATOR_MISSING_MAGIC
+		if storageFilter.IsInteresting(valIndex, VALIDATOR_MISSING_MAGIC) {
+			flagInteresting(valIndex)
+		}
 	}
 }
 
 ////////////////////////////////////////////////////////////////////////////
 
-// TODO Track first fully seen epoch and last epoch. All between is good.
-
 // Track slots seen in this epoch. Used to make sure we only dump metrics about
 // epochs we have completely seen
 var firstSlotSeen common.Slot
 var lastSlotSeen common.Slot
 
+// Whether firstSlotSeen is set (it can legitimately be slot zero)
+var firstSlotKnown bool
+
+// Slots that had no block (missed or orphaned proposals), for the epochs we
+// are still tracking
+var emptySlots = map[common.Slot]bool{}
+
+// The database we flush finished epochs to
+var activityDB db.Storage
+
+// Whether we save checkpoints to resume from
+var checkpointing bool
+
+// Decides which validators are interesting
+var storageFilter StorageFilter
+
+// Whether we also store every observed duty (in compact form)
+var storeAllDuties bool
+
+// Set the database that the activity tracker writes to, whether it should
+// also save checkpoints there, which validators it should consider
+// interesting, and whether it should also store every observed duty
+func InitActivityTracker(database db.Storage, enableCheckpoints bool, filter StorageFilter, allDuties bool) {
+	activityDB = database
+	checkpointing = enableCheckpoints
+	storageFilter = filter
+	storeAllDuties = allDuties
+}
+
+// We are going to look at every slot from `slot` on (e.g. when backfilling a
+// range), so the epochs from there on count as fully seen even if their first
+// slots turn out to be empty
+func StartFromSlot(slot common.Slot) {
+	firstSlotSeen = slot
+	firstSlotKnown = true
+}
 
 // A new block was processed. Register it for the purposes of figuring out how
 // many epochs we've seen
 func registerNewBlock(slot common.Slot) {
-	if firstSlotSeen == 0 {
+	if !firstSlotKnown {
 		firstSlotSeen = slot
+		firstSlotKnown = true
+	}
+
+	// Blocks we catch up on after a reorg can be older than the last one
+	if slot > lastSlotSeen {
+		lastSlotSeen = slot
+	}
+}
+
+// There is no block at `slot`, so its proposal was missed. Blocks are
+// processed in order, so this must be called before handling the blocks after
+// `slot`.
+func RegisterEmptySlot(slot common.Slot) {
+	emptySlots[slot] = true
+	recordProposal(slot, expectedProposer(slot), db.ProposalMissed, "")
+}
+
+// Return the inclusion distance of an attestation to `attestationSlot` found
+// in `blockSlot`, not counting the empty slots in between
+func effectiveInclusionDistance(attestationSlot common.Slot, blockSlot common.Slot) int {
+	distance := int(blockSlot - attestationSlot)
+	for slot := attestationSlot + 1; slot < blockSlot; slot++ {
+		if emptySlots[slot] {
+			distance--
+		}
+	}
+	return distance
+}
+
+// Return the epochs we are currently tracking, in order
+func trackedEpochs() []common.Epoch {
+	var epochs []common.Epoch
+	for epoch := range validatorActivityTracker {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs
+}
+
+// Write the activity of `epoch` to the database and forget about it. Only
+// validators that have been interesting so far (or that we watch) get written
+// to validator_state, but every duty gets written if storeAllDuties is set.
+// Returns the number of rows written.
+//
+// Rows are upserted, so writing an epoch again (e.g. after resuming from a
+// checkpoint) does not duplicate them, and we don't clobber the rows that
+// other visits sharing the database wrote.
+func flushEpoch(epoch common.Epoch) (int, error) {
+	events := epochLifecycleEvents(epoch)
+	learnStatuses(events)
+
+	var allRows, rows []db.ActivityRow
+	for validator, state := range validatorActivityTracker[epoch] {
+		row := db.ActivityRow{
+			ValidatorIdx:      int(validator),
+			Epoch:             int(epoch),
+			Distance:          state,
+			EffectiveDistance: validatorEffectiveTracker[epoch][validator],
+			Flags:             validatorFlagsTracker[epoch][validator],
+		}
+		if storeAllDuties {
+			allRows = append(allRows, row)
+		}
+		if interestingValidators[validator] || watchlist[validator] {
+			rows = append(rows, row)
+		}
 	}
 
-	lastSlotSeen = slot
+	statuses := missingValidatorStatuses(epoch, rows)
+	applyStatuses(rows, statuses)
 
-	// TODO this function should be called after the block is processed, and
-	// when we move past an epoch, it should spawn a goroutine that dumps the
-	// activity tracker of the epoch that just passed to the database
+	if storeAllDuties {
+		if err := activityDB.RegisterEpochDuties(int(epoch), allRows); err != nil {
+			return 0, err
+		}
+	}
+	if err := activityDB.RegisterAttestations(rows); err != nil {
+		return 0, err
+	}
+	blocks := epochProposals(epoch)
+	if err := activityDB.RegisterProposals(blocks); err != nil {
+		return 0, err
+	}
+	if err := activityDB.RegisterSyncParticipation(epochSyncRows(epoch)); err != nil {
+		return 0, err
+	}
+	if err := activityDB.RegisterLifecycleEvents(events); err != nil {
+		return 0, err
+	}
+	if err := activityDB.RegisterWatchlistDuties(epochWatchDuties(epoch)); err != nil {
+		return 0, err
+	}
+	if err := registerEpochRewards(epoch, rows, blocks); err != nil {
+		return 0, err
+	}
+
+	recordEpochMetrics(epoch, statuses)
+	forgetEpoch(epoch)
+	return len(rows), nil
 }
 
-func DumpActivityTracker() {
+// Stop tracking the activity of `epoch`. Attestations of later epochs can't
+// span its empty slots either, so forget about them too.
+func forgetEpoch(epoch common.Epoch) {
+	delete(validatorActivityTracker, epoch)
+	delete(validatorEffectiveTracker, epoch)
+	delete(validatorFlagsTracker, epoch)
+	delete(syncParticipationTracker, epoch)
+
+	end := ComputeStartSlotAtEpoch(epoch + 1)
+	for slot := range emptySlots {
+		if slot < end {
+			delete(emptySlots, slot)
+		}
+	}
+	forgetProposals(epoch)
+	forgetLifecycleEvents(epoch)
+	forgetWatchedAssignments(epoch)
+	forgetJournal(epoch)
+}
+
+// Report what we saw in `epoch` (every validator we saw, interesting or not).
+// Missing validators that are not active anymore according to `statuses` (or
+// to the events we have seen, for the ones we did not write) are reported as
+// inactive instead.
+func recordEpochMetrics(epoch common.Epoch, statuses map[common.ValidatorIndex]string) {
+	var included, slow, missing, inactive int
+	for validator, state := range validatorActivityTracker[epoch] {
+		if state == VALIDATOR_MISSING_MAGIC {
+			status, ok := statuses[validator]
+			if !ok {
+				status = knownStatuses[validator]
+			}
+			if db.StatusIsActive(status) {
+				missing++
+			} else {
+				inactive++
+			}
+			continue
+		}
+		effective := validatorEffectiveTracker[epoch][validator]
+		included++
+		if effective > 1 {
+			slow++
+		}
+		metrics.InclusionDistance.Observe(float64(state))
+		metrics.EffectiveInclusionDistance.Observe(float64(effective))
+	}
+
+	metrics.LastFlushedEpoch.Set(float64(epoch))
+	metrics.EpochMissingValidators.Set(float64(missing))
+	metrics.EpochInactiveValidators.Set(float64(inactive))
+	metrics.EpochSlowValidators.Set(float64(slow))
+	if included+missing > 0 {
+		metrics.EpochParticipationRate.Set(float64(included) / float64(included+missing))
+	}
+}
+
+// The block at `blockSlot` was processed. Flush every epoch whose inclusion
+// window (the epoch itself plus one full epoch) is over, since no block from
+// now on can tell us anything new about it. Epochs we did not see from their
+// beginning are dropped instead. Returns the finished epochs, so that the
+// caller can evict them too.
+func flushFinishedEpochs(blockSlot common.Slot) ([]common.Epoch, error) {
+	firstFullEpoch := firstEpochAfterSlot(firstSlotSeen)
+	currentEpoch := ComputeEpochAtSlot(blockSlot)
+
+	var finished []common.Epoch
+	for _, epoch := range trackedEpochs() {
+		if epoch+2 > currentEpoch { // still within the inclusion window
+			break
+		}
+		finished = append(finished, epoch)
+
+		if epoch < firstFullEpoch {
+			fmt.Printf("[*] Dropping partially seen epoch #%d\n", epoch)
+			forgetEpoch(epoch)
+			continue
+		}
+
+		written, err := flushEpoch(epoch)
+		if err != nil {
+			return finished, err
+		}
+		fmt.Printf("[*] Flushed epoch #%d to the database (%d validators, %d interesting so far)\n",
+			epoch, written, numInterestingValidators)
+	}
+	return finished, nil
+}
+
+// Dump the activity of all remaining fully seen epochs to the database. Used
+// when wrapping up, on top of the flushes we do as epochs finish.
+func DumpActivityTracker() error {
 	fmt.Printf("Dumping the data! Brace for impact.\n")
 
 	// Track which epochs have been fully seen (we were here in their beginning and end)
-	var fullySeenEpochs []common.Epoch
 	first_epoch := firstEpochAfterSlot(firstSlotSeen)
 	last_epoch := lastEpochBeforeSlot(lastSlotSeen)
-	for epoch := first_epoch ; epoch <= last_epoch ; epoch++ {
-		fullySeenEpochs = append(fullySeenEpochs, epoch)
-	}
 
-	fmt.Printf("We have %d interesting validators over %d fully seen epochs: %v\n", numInterestingValidators, len(fullySeenEpochs),fullySeenEpochs)
-
-	db := db.InitDatabase()
-	defer db.Close()
+	fmt.Printf("We have %d interesting validators over epochs #%d to #%d\n", numInterestingValidators, first_epoch, last_epoch)
 
 	var i int
-	for _, epoch := range fullySeenEpochs {
-		validatorMap := validatorActivityTracker[epoch]
-		for validator, state := range validatorMap {
-			if interestingValidators[validator] == false {
-				continue
-			}
-			if i%1000 == 0 {
-				fmt.Printf("Dumping %dth validator...\n", i)
-			}
-			db.RegisterAttestation(int(validator), int(epoch), state)
-			i++
+	for _, epoch := range trackedEpochs() {
+		if epoch < first_epoch || epoch > last_epoch {
+			continue
 		}
+		written, err := flushEpoch(epoch)
+		if err != nil {
+			return err
+		}
+		i += written
+		fmt.Printf("Dumped epoch #%d (%d validators so far)...\n", epoch, i)
 	}
+
+	return nil
 }
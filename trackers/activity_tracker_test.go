@@ -0,0 +1,128 @@
+package trackers
+
+import (
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// A db.Storage that keeps what the trackers write to it
+type testStorage struct {
+	db.Storage
+	activity    []db.ActivityRow
+	proposals   []db.ProposalRow
+	sync        []db.SyncRow
+	watchDuties []db.WatchDutyRow
+}
+
+func (s *testStorage) RegisterAttestations(rows []db.ActivityRow) error {
+	s.activity = append(s.activity, rows...)
+	return nil
+}
+
+func (s *testStorage) RegisterProposals(rows []db.ProposalRow) error {
+	s.proposals = append(s.proposals, rows...)
+	return nil
+}
+
+func (s *testStorage) RegisterSyncParticipation(rows []db.SyncRow) error {
+	s.sync = append(s.sync, rows...)
+	return nil
+}
+
+func (s *testStorage) RegisterLifecycleEvents(rows []db.LifecycleRow) error {
+	return nil
+}
+
+func (s *testStorage) RegisterWatchlistDuties(rows []db.WatchDutyRow) error {
+	s.watchDuties = append(s.watchDuties, rows...)
+	return nil
+}
+
+// Like resetJournalTest(), with every slot from zero on seen, and epochs
+// flushed to the returned storage
+func resetFlushTest(t *testing.T) *testStorage {
+	resetJournalTest(t)
+	storage := &testStorage{}
+	activityDB = storage
+	StartFromSlot(0)
+	lastSlotSeen = 0
+	expectedProposers = map[common.Slot]common.ValidatorIndex{}
+	knownStatuses = map[common.ValidatorIndex]string{}
+	t.Cleanup(func() {
+		activityDB = nil
+		firstSlotSeen, lastSlotSeen, firstSlotKnown = 0, 0, false
+		knownStatuses = map[common.ValidatorIndex]string{}
+	})
+	return storage
+}
+
+func TestEpochMetricsAfterFlush(t *testing.T) {
+	resetFlushTest(t)
+	knownStatuses[5] = "exited_unslashed"
+	committee := []common.ValidatorIndex{1, 2, 3, 4, 5}
+
+	// In epoch 1, validators 1 and 2 make it right away, validator 3 two
+	// slots late, and validators 4 and 5 not at all
+	processTestBlock(5, testAttestation(4, committee, 0, 1))
+	processTestBlock(7, testAttestation(4, committee, 2))
+	if _, err := flushEpoch(1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		value    float64
+		expected float64
+	}{
+		{"last flushed epoch", testutil.ToFloat64(metrics.LastFlushedEpoch), 1},
+		{"missing", testutil.ToFloat64(metrics.EpochMissingValidators), 1},
+		{"inactive", testutil.ToFloat64(metrics.EpochInactiveValidators), 1},
+		{"slow", testutil.ToFloat64(metrics.EpochSlowValidators), 1},
+		{"participation rate", testutil.ToFloat64(metrics.EpochParticipationRate), 0.75},
+	} {
+		if test.value != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, test.value, test.expected)
+		}
+	}
+}
+
+func TestEffectiveDistanceOverEmptySlots(t *testing.T) {
+	resetFlushTest(t)
+
+	// Slot 3 is empty, before any of the attestations below
+	RegisterEmptySlot(3)
+	processTestBlock(5, testAttestation(4, []common.ValidatorIndex{1}, 0))
+	processTestBlock(6, testAttestation(4, []common.ValidatorIndex{2}, 0))
+
+	// Slots 7 and 8 are empty, across the boundary of epochs 1 and 2
+	RegisterEmptySlot(7)
+	RegisterEmptySlot(8)
+	processTestBlock(9,
+		testAttestation(6, []common.ValidatorIndex{3}, 0),
+		testAttestation(5, []common.ValidatorIndex{4}, 0),
+		testAttestation(8, []common.ValidatorIndex{5}, 0))
+
+	for _, test := range []struct {
+		validator common.ValidatorIndex
+		epoch     common.Epoch
+		distance  int
+		effective int
+	}{
+		{1, 1, 1, 1},
+		{2, 1, 2, 2}, // slot 3 is before the attestation
+		{3, 1, 3, 1}, // slots 7 and 8 don't count
+		{4, 1, 4, 2}, // slot 6 had a block
+		{5, 2, 1, 1},
+	} {
+		distance := validatorActivityTracker[test.epoch][test.validator]
+		effective := validatorEffectiveTracker[test.epoch][test.validator]
+		if distance != test.distance || effective != test.effective {
+			t.Errorf("validator %d: got distance %d (effective %d), expected %d (effective %d)",
+				test.validator, distance, effective, test.distance, test.effective)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/// This module keeps a journal of what each recent block contributed to the
+/// trackers, so that blocks that get reorged out can be rolled back: we throw
+/// away what we know about the epochs still in memory and re-apply the
+/// contributions of the blocks that are still part of the chain.
+///
+/// Epochs that were already flushed to the database are not touched, and
+/// validators stay interesting even if it was an orphaned block that made
+/// them so.
+
+package trackers
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// An attestation of a block, resolved against its committee
+type attestationRecord struct {
+	slot      common.Slot
+	committee []common.ValidatorIndex
+	bits      phase0.AttestationBits
+	flags     int
+}
+
+// What a block contributed to the trackers
+type blockRecord struct {
+	slot       common.Slot
+	root       common.Root
+	parentRoot common.Root
+	proposer   int
+
+	attestations []attestationRecord
+
+	// The sync aggregate of the block (nil before altair) and the sync
+	// committee it speaks for
+	syncBits      altair.SyncCommitteeBits
+	syncCommittee []common.ValidatorIndex
+}
+
+// The blocks that contributed to the epochs we are still tracking, in the
+// order we processed them
+var journal []*blockRecord
+
+// The block we are processing right now (the last one in the journal)
+var currentBlock *blockRecord
+
+// What we knew before the first block of the journal: the state we resumed
+// from, if any. Rolling back starts over from here.
+var journalBase = struct {
+	activity  map[common.Epoch]map[common.ValidatorIndex]int
+	effective map[common.Epoch]map[common.ValidatorIndex]int
+	flags     map[common.Epoch]map[common.ValidatorIndex]int
+	sync      map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow
+}{}
+
+// Epochs before this one have been flushed (or dropped): nothing can
+// contribute to them anymore
+var forgottenBefore common.Epoch
+
+// Start journaling the contributions of the block `root` at `slot`
+func journalBlock(slot common.Slot, root common.Root, parentRoot common.Root, proposer int) {
+	currentBlock = &blockRecord{slot: slot, root: root, parentRoot: parentRoot, proposer: proposer}
+	journal = append(journal, currentBlock)
+}
+
+// If we have processed block `root`, return its slot
+func JournaledBlock(root common.Root) (common.Slot, bool) {
+	for _, rec := range journal {
+		if rec.root == root {
+			return rec.slot, true
+		}
+	}
+	return 0, false
+}
+
+// Return the slot of the oldest block in the journal. Blocks older than this
+// can't be rolled back. Returns false if the journal is empty.
+func JournalHorizon() (common.Slot, bool) {
+	if len(journal) == 0 {
+		return 0, false
+	}
+	horizon := journal[0].slot
+	for _, rec := range journal {
+		if rec.slot < horizon {
+			horizon = rec.slot
+		}
+	}
+	return horizon, true
+}
+
+// Roll back every block after `slot`: they are not part of the chain anymore.
+// Returns how many blocks were rolled back.
+func RollBackBlocksAfter(slot common.Slot) int {
+	var kept, orphaned []*blockRecord
+	for _, rec := range journal {
+		if rec.slot > slot {
+			orphaned = append(orphaned, rec)
+		} else {
+			kept = append(kept, rec)
+		}
+	}
+	if len(orphaned) == 0 {
+		return 0
+	}
+
+	for _, rec := range orphaned {
+		fmt.Printf("[!] Rolling back block %s of slot #%d\n", rec.root, rec.slot)
+		recordProposal(rec.slot, rec.proposer, db.ProposalOrphaned, rec.root.String())
+		// As far as the chain is concerned, there is no block there
+		emptySlots[rec.slot] = true
+	}
+	metrics.Reorgs.Inc()
+	rollBackLifecycleEvents(slot)
+
+	journal = kept
+	currentBlock = nil
+	rebuildFromJournal()
+	return len(orphaned)
+}
+
+// The blocks up to `slot` are finalized: they can't be rolled back anymore, so
+// fold their contributions into journalBase and drop them from the journal.
+// Returns how many blocks were dropped.
+func FinalizeBlocksUpTo(slot common.Slot) int {
+	var finalized, kept []*blockRecord
+	for _, rec := range journal {
+		if rec.slot <= slot {
+			finalized = append(finalized, rec)
+		} else {
+			kept = append(kept, rec)
+		}
+	}
+	if len(finalized) == 0 {
+		return 0
+	}
+
+	// Replay the finalized blocks on top of the base to get the new base,
+	// leaving the current state of the trackers alone
+	activity, effective, flags, sync := validatorActivityTracker, validatorEffectiveTracker,
+		validatorFlagsTracker, syncParticipationTracker
+	interesting := make(map[common.ValidatorIndex]bool, len(interestingValidators))
+	for valIndex := range interestingValidators {
+		interesting[valIndex] = true
+	}
+	journal = finalized
+	rebuildFromJournal()
+	journalBase.activity = validatorActivityTracker
+	journalBase.effective = validatorEffectiveTracker
+	journalBase.flags = validatorFlagsTracker
+	journalBase.sync = syncParticipationTracker
+
+	journal = kept
+	validatorActivityTracker, validatorEffectiveTracker = activity, effective
+	validatorFlagsTracker, syncParticipationTracker = flags, sync
+	interestingValidators, numInterestingValidators = interesting, len(interesting)
+	return len(finalized)
+}
+
+// Start over from journalBase and re-apply the contributions of every block
+// in the journal
+func rebuildFromJournal() {
+	validatorActivityTracker = copyEpochMaps(journalBase.activity)
+	validatorEffectiveTracker = copyEpochMaps(journalBase.effective)
+	validatorFlagsTracker = copyEpochMaps(journalBase.flags)
+	syncParticipationTracker = copySyncMaps(journalBase.sync)
+
+	for _, rec := range journal {
+		for _, att := range rec.attestations {
+			applyAttestation(att, rec.slot)
+		}
+		if rec.syncBits != nil {
+			applySyncAggregate(rec.slot, rec.syncCommittee, rec.syncBits)
+		}
+	}
+}
+
+// Make the current state of the trackers the base to roll back to (e.g. after
+// restoring a checkpoint, since the journal did not make it there)
+func resetJournal() {
+	journal = nil
+	currentBlock = nil
+	journalBase.activity = copyEpochMaps(validatorActivityTracker)
+	journalBase.effective = copyEpochMaps(validatorEffectiveTracker)
+	journalBase.flags = copyEpochMaps(validatorFlagsTracker)
+	journalBase.sync = copySyncMaps(syncParticipationTracker)
+}
+
+// Forget the blocks that can only contribute to `epoch` and before, which
+// we are done with
+func forgetJournal(epoch common.Epoch) {
+	if epoch+1 > forgottenBefore {
+		forgottenBefore = epoch + 1
+	}
+
+	// Blocks of the next epoch can still contribute to it
+	end := ComputeStartSlotAtEpoch(epoch + 1)
+	var kept []*blockRecord
+	for _, rec := range journal {
+		if rec.slot >= end {
+			kept = append(kept, rec)
+		}
+	}
+	journal = kept
+
+	delete(journalBase.activity, epoch)
+	delete(journalBase.effective, epoch)
+	delete(journalBase.flags, epoch)
+	delete(journalBase.sync, epoch)
+}
+
+func copyEpochMaps(m map[common.Epoch]map[common.ValidatorIndex]int) map[common.Epoch]map[common.ValidatorIndex]int {
+	c := make(map[common.Epoch]map[common.ValidatorIndex]int, len(m))
+	for epoch, validators := range m {
+		c[epoch] = make(map[common.ValidatorIndex]int, len(validators))
+		for validator, v := range validators {
+			c[epoch][validator] = v
+		}
+	}
+	return c
+}
+
+func copySyncMaps(m map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow) map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow {
+	c := make(map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow, len(m))
+	for epoch, validators := range m {
+		c[epoch] = make(map[common.ValidatorIndex]*db.SyncRow, len(validators))
+		for validator, row := range validators {
+			rowCopy := *row
+			c[epoch][validator] = &rowCopy
+		}
+	}
+	return c
+}
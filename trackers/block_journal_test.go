@@ -0,0 +1,163 @@
+package trackers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// Start the trackers over, with 4 slots per epoch and only missing validators
+// being interesting
+func resetJournalTest(t *testing.T) {
+	oldSlotsPerEpoch := slotsPerEpoch
+	slotsPerEpoch = 4
+	t.Cleanup(func() { slotsPerEpoch = oldSlotsPerEpoch })
+
+	filter, err := NewStorageFilter(FilterMissing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageFilter = filter
+
+	validatorActivityTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+	validatorEffectiveTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+	validatorFlagsTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+	syncParticipationTracker = map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow{}
+	interestingValidators = map[common.ValidatorIndex]bool{}
+	numInterestingValidators = 0
+	emptySlots = map[common.Slot]bool{}
+	proposals = map[common.Slot]*db.ProposalRow{}
+	forgottenBefore = 0
+	resetJournal()
+}
+
+// An attestation to `slot` by `committee`, where only the members in
+// `present` made it in
+func testAttestation(slot common.Slot, committee []common.ValidatorIndex, present ...int) attestationRecord {
+	bits := make(phase0.AttestationBits, len(committee)/8+1)
+	for _, i := range present {
+		bits[i/8] |= 1 << uint(i%8)
+	}
+	// The bitlist length bit
+	bits[len(committee)/8] |= 1 << uint(len(committee)%8)
+	return attestationRecord{slot: slot, committee: committee, bits: bits, flags: TIMELY_SOURCE_FLAG}
+}
+
+// Process the block of `slot`, the way the committee tracker does
+func processTestBlock(slot common.Slot, attestations ...attestationRecord) {
+	RegisterBlockProposal(slot, 0, common.Root{byte(slot)}, common.Root{byte(slot - 1)})
+	for _, att := range attestations {
+		currentBlock.attestations = append(currentBlock.attestations, att)
+		applyAttestation(att, slot)
+	}
+}
+
+func TestFinalizeBlocksUpTo(t *testing.T) {
+	resetJournalTest(t)
+	committee := []common.ValidatorIndex{1, 2}
+
+	// Validator 2 misses its attestation of epoch 0 at first, shows up
+	// late, and then misses epoch 1
+	processTestBlock(1, testAttestation(0, committee, 0))
+	processTestBlock(2, testAttestation(0, committee, 1))
+	processTestBlock(5, testAttestation(4, committee, 0))
+	if !interestingValidators[2] {
+		t.Fatal("validator 2 should be interesting for missing epoch 1")
+	}
+	activity := copyEpochMaps(validatorActivityTracker)
+
+	if n := FinalizeBlocksUpTo(2); n != 2 {
+		t.Fatalf("finalized %d blocks, expected 2", n)
+	}
+	if len(journal) != 1 || journal[0].slot != 5 {
+		t.Errorf("the journal should only hold the block of slot 5: %v", journal)
+	}
+	if _, ok := JournaledBlock(common.Root{1}); ok {
+		t.Error("finalized blocks should not be in the journal anymore")
+	}
+
+	// Nothing changed as far as the trackers are concerned...
+	if !reflect.DeepEqual(validatorActivityTracker, activity) {
+		t.Errorf("finalizing changed the activity: %v, expected %v", validatorActivityTracker, activity)
+	}
+	if !interestingValidators[2] || numInterestingValidators != 1 {
+		t.Errorf("finalizing changed the interesting validators: %v", interestingValidators)
+	}
+
+	// ...but the finalized blocks are now part of the base
+	expectedBase := map[common.Epoch]map[common.ValidatorIndex]int{0: {1: 1, 2: 2}}
+	if !reflect.DeepEqual(journalBase.activity, expectedBase) {
+		t.Errorf("base activity is %v, expected %v", journalBase.activity, expectedBase)
+	}
+
+	// Rolling back can't go past finality
+	if n := RollBackBlocksAfter(0); n != 1 {
+		t.Fatalf("rolled back %d blocks, expected 1", n)
+	}
+	if !reflect.DeepEqual(validatorActivityTracker, expectedBase) {
+		t.Errorf("activity after the rollback is %v, expected %v", validatorActivityTracker, expectedBase)
+	}
+}
+
+func TestRollBackBlocksAfter(t *testing.T) {
+	resetJournalTest(t)
+	lifecycleEvents = map[common.Slot][]db.LifecycleRow{}
+	committee := []common.ValidatorIndex{1, 2}
+
+	// Validator 2 only makes it in with the block of slot 3, which gets
+	// orphaned along with the block of slot 5
+	processTestBlock(1, testAttestation(0, committee, 0))
+	processTestBlock(2)
+	activity := copyEpochMaps(validatorActivityTracker)
+	processTestBlock(3, testAttestation(0, committee, 1))
+	processTestBlock(5, testAttestation(4, committee, 0, 1))
+	lifecycleEvents[2] = []db.LifecycleRow{{Slot: 2}}
+	lifecycleEvents[3] = []db.LifecycleRow{{Slot: 3}}
+
+	if n := RollBackBlocksAfter(2); n != 2 {
+		t.Fatalf("rolled back %d blocks, expected 2", n)
+	}
+	if !reflect.DeepEqual(validatorActivityTracker, activity) {
+		t.Errorf("activity after the rollback is %v, expected %v", validatorActivityTracker, activity)
+	}
+	if _, ok := JournaledBlock(common.Root{3}); ok {
+		t.Error("orphaned blocks should not be in the journal anymore")
+	}
+	if len(journal) != 2 || currentBlock != nil {
+		t.Errorf("the journal should only hold the blocks of slots 1 and 2: %v", journal)
+	}
+
+	for _, slot := range []common.Slot{3, 5} {
+		if p := proposals[slot]; p == nil || p.Status != db.ProposalOrphaned {
+			t.Errorf("the proposal of slot #%d should be orphaned: %+v", slot, p)
+		}
+		if !emptySlots[slot] {
+			t.Errorf("slot #%d should be empty after the rollback", slot)
+		}
+	}
+	if p := proposals[2]; p == nil || p.Status != db.ProposalProposed {
+		t.Errorf("the proposal of slot #2 should be left alone: %+v", p)
+	}
+	if _, ok := lifecycleEvents[3]; ok || len(lifecycleEvents[2]) != 1 {
+		t.Errorf("only the lifecycle events after slot #2 should be rolled back: %v", lifecycleEvents)
+	}
+
+	// Validators stay interesting even if an orphaned block made them so
+	if !interestingValidators[2] {
+		t.Error("validator 2 should still be interesting")
+	}
+
+	// Nothing left to roll back
+	if n := RollBackBlocksAfter(2); n != 0 {
+		t.Errorf("rolled back %d blocks twice", n)
+	}
+
+	// The block of the new chain takes the place of the orphaned one
+	RegisterBlockProposal(3, 7, common.Root{0x33}, common.Root{2})
+	if emptySlots[3] || proposals[3].Status != db.ProposalProposed || proposals[3].ProposerIdx != 7 {
+		t.Errorf("slot #3 should have the block of the new chain: %+v", proposals[3])
+	}
+}
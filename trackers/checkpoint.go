@@ -0,0 +1,153 @@
+/// This module saves the state of the trackers to the database and restores
+/// it, so that a restarted visit can pick up where it left off instead of
+/// throwing away the epochs it was in the middle of.
+
+package trackers
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Save the state of the trackers (including the committees of `ct`) to the
+// database, if checkpointing is enabled
+func SaveCheckpoint(ct *CommitteeTracker) error {
+	if !checkpointing || lastSlotSeen == 0 { // nothing to save
+		return nil
+	}
+
+	cp := db.Checkpoint{
+		LastSlot:      int(lastSlotSeen),
+		FirstSlotSeen: int(firstSlotSeen),
+	}
+
+	for epoch, validatorMap := range validatorActivityTracker {
+		for validator, state := range validatorMap {
+			cp.PendingActivity = append(cp.PendingActivity, db.ActivityRow{
+				ValidatorIdx:      int(validator),
+				Epoch:             int(epoch),
+				Distance:          state,
+				EffectiveDistance: validatorEffectiveTracker[epoch][validator],
+				Flags:             validatorFlagsTracker[epoch][validator],
+			})
+		}
+	}
+
+	for validator, interesting := range interestingValidators {
+		if interesting {
+			cp.InterestingValidators = append(cp.InterestingValidators, int(validator))
+		}
+	}
+
+	for slot := range emptySlots {
+		cp.EmptySlots = append(cp.EmptySlots, int(slot))
+	}
+
+	for _, p := range proposals {
+		cp.PendingProposals = append(cp.PendingProposals, *p)
+	}
+
+	for _, participation := range syncParticipationTracker {
+		for _, row := range participation {
+			cp.PendingSync = append(cp.PendingSync, *row)
+		}
+	}
+
+	for _, events := range lifecycleEvents {
+		cp.PendingEvents = append(cp.PendingEvents, events...)
+	}
+
+	for _, committees := range ct.tracker {
+		for _, c := range committees {
+			row := db.CommitteeRow{Slot: int(c.Slot), Index: int(c.Index)}
+			for _, validator := range c.Validators {
+				row.Validators = append(row.Validators, int(validator))
+			}
+			cp.Committees = append(cp.Committees, row)
+		}
+	}
+
+	if err := activityDB.SaveCheckpoint(&cp); err != nil {
+		return err
+	}
+	fmt.Printf("[*] Checkpointed at slot #%d (%d pending rows, %d committees)\n",
+		cp.LastSlot, len(cp.PendingActivity), len(cp.Committees))
+	return nil
+}
+
+// Restore the state of the trackers (including the committees of `ct`) from `cp`
+func RestoreCheckpoint(ct *CommitteeTracker, cp *db.Checkpoint) {
+	firstSlotSeen = common.Slot(cp.FirstSlotSeen)
+	firstSlotKnown = true
+	lastSlotSeen = common.Slot(cp.LastSlot)
+
+	validatorActivityTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+	validatorEffectiveTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+	validatorFlagsTracker = map[common.Epoch]map[common.ValidatorIndex]int{}
+	for _, row := range cp.PendingActivity {
+		epoch := common.Epoch(row.Epoch)
+		if validatorActivityTracker[epoch] == nil {
+			validatorActivityTracker[epoch] = make(map[common.ValidatorIndex]int)
+			validatorEffectiveTracker[epoch] = make(map[common.ValidatorIndex]int)
+			validatorFlagsTracker[epoch] = make(map[common.ValidatorIndex]int)
+		}
+		validatorActivityTracker[epoch][common.ValidatorIndex(row.ValidatorIdx)] = row.Distance
+		validatorEffectiveTracker[epoch][common.ValidatorIndex(row.ValidatorIdx)] = row.EffectiveDistance
+		if row.Flags != 0 {
+			validatorFlagsTracker[epoch][common.ValidatorIndex(row.ValidatorIdx)] = row.Flags
+		}
+	}
+
+	emptySlots = map[common.Slot]bool{}
+	for _, slot := range cp.EmptySlots {
+		emptySlots[common.Slot(slot)] = true
+	}
+
+	proposals = map[common.Slot]*db.ProposalRow{}
+	for i := range cp.PendingProposals {
+		p := cp.PendingProposals[i]
+		proposals[common.Slot(p.Slot)] = &p
+	}
+
+	syncParticipationTracker = map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow{}
+	for i := range cp.PendingSync {
+		row := cp.PendingSync[i]
+		epoch := common.Epoch(row.Epoch)
+		if syncParticipationTracker[epoch] == nil {
+			syncParticipationTracker[epoch] = make(map[common.ValidatorIndex]*db.SyncRow)
+		}
+		syncParticipationTracker[epoch][common.ValidatorIndex(row.ValidatorIdx)] = &row
+	}
+
+	lifecycleEvents = map[common.Slot][]db.LifecycleRow{}
+	for _, e := range cp.PendingEvents {
+		lifecycleEvents[common.Slot(e.Slot)] = append(lifecycleEvents[common.Slot(e.Slot)], e)
+	}
+
+	interestingValidators = map[common.ValidatorIndex]bool{}
+	for _, validator := range cp.InterestingValidators {
+		interestingValidators[common.ValidatorIndex(validator)] = true
+	}
+	numInterestingValidators = len(cp.InterestingValidators)
+
+	ct.tracker = make(map[common.Slot][]eth2api.Committee)
+	watchedAssignments = map[common.Epoch]map[common.ValidatorIndex]*db.WatchDutyRow{}
+	for _, row := range cp.Committees {
+		c := eth2api.Committee{Index: common.CommitteeIndex(row.Index), Slot: common.Slot(row.Slot)}
+		for _, validator := range row.Validators {
+			c.Validators = append(c.Validators, common.ValidatorIndex(validator))
+		}
+		ct.tracker[c.Slot] = append(ct.tracker[c.Slot], c)
+		registerWatchedAssignments([]eth2api.Committee{c})
+	}
+	ct.updateCacheSize()
+
+	// Blocks from before the checkpoint can't be rolled back anymore
+	resetJournal()
+
+	fmt.Printf("[!] Restored checkpoint of slot #%d (%d pending rows, %d committees)\n",
+		cp.LastSlot, len(cp.PendingActivity), len(cp.Committees))
+}
@@ -5,9 +5,9 @@
 package trackers
 
 import (
-	"errors"
 	"fmt"
 
+	"github.com/asn-d6/visit/metrics"
 	"github.com/protolambda/eth2api"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
@@ -43,6 +43,26 @@ func (ct *CommitteeTracker) RegisterCommittees(committees []eth2api.Committee) {
 		// Register the committee for that slot
 		ct.tracker[c.Slot] = append(ct.tracker[c.Slot], c)
 	}
+	registerWatchedAssignments(committees)
+	ct.updateCacheSize()
+}
+
+// Report how many committees we are tracking
+func (ct *CommitteeTracker) updateCacheSize() {
+	var n int
+	for _, committees := range ct.tracker {
+		n += len(committees)
+	}
+	metrics.CommitteeCacheSize.Set(float64(n))
+}
+
+// Stop tracking the committees of `epoch`
+func (ct *CommitteeTracker) evictEpoch(epoch common.Epoch) {
+	start := ComputeStartSlotAtEpoch(epoch)
+	for slot := start; slot < ComputeStartSlotAtEpoch(epoch+1); slot++ {
+		delete(ct.tracker, slot)
+	}
+	ct.updateCacheSize()
 }
 
 // Check whether we are tracking the committes for `slot`
@@ -53,6 +73,16 @@ func (ct *CommitteeTracker) CommitteesAreKnownForSlot(slot common.Slot) bool {
 	return true
 }
 
+// An attestation referenced a committee we are not tracking
+type UnknownCommitteeError struct {
+	Index common.CommitteeIndex
+	Slot  common.Slot
+}
+
+func (e *UnknownCommitteeError) Error() string {
+	return fmt.Sprintf("unknown committee #%d for slot #%d", e.Index, e.Slot)
+}
+
 // Return the committee for the given index/slot, or an error if it can't be found
 func (ct *CommitteeTracker) getCommitteeFromIndex(index common.CommitteeIndex, slot common.Slot) (*eth2api.Committee, error) {
 	for _, c := range ct.tracker[slot] {
@@ -60,16 +90,16 @@ func (ct *CommitteeTracker) getCommitteeFromIndex(index common.CommitteeIndex, s
 			return &c, nil
 		}
 	}
-	return nil, errors.New("No committee found")
+	return nil, &UnknownCommitteeError{Index: index, Slot: slot}
 }
 
-// Given an attestation (found in `blockSlot`), handle it and register the
-// validators with the activity tracker
-func (ct *CommitteeTracker) handleAttestation(att phase0.Attestation, blockSlot common.Slot) {
+// Given an attestation (found in `blockSlot`) that earns the participation
+// `flags`, handle it and register the validators with the activity tracker
+func (ct *CommitteeTracker) handleAttestation(att phase0.Attestation, flags int, blockSlot common.Slot) error {
 	committee, err := ct.getCommitteeFromIndex(att.Data.Index, att.Data.Slot)
 	if err != nil {
 		fmt.Printf("[*] Debugging attestation for committee #%d and slot #%d...\n", att.Data.Index, att.Data.Slot)
-		panic("didnt know the committee")
+		return err
 	}
 
 	//	fmt.Printf("[*] Handling attestation (%d bits set) for committee #%d (%d validators) and slot #%d (bitfield: %s)\n",
@@ -79,24 +109,85 @@ func (ct *CommitteeTracker) handleAttestation(att phase0.Attestation, blockSlot
 	// the committee composition we are tracking. These two must not get desynced.
 	if !ct.CommitteesAreKnownForSlot(att.Data.Slot) {
 		fmt.Printf("[*] Debugging attestation for committee #%d and slot #%d...\n", att.Data.Index, att.Data.Slot)
-		panic("after all... we didn't really visit our committees...")
+		return &UnknownCommitteeError{Index: att.Data.Index, Slot: att.Data.Slot}
 	}
 
 	//	fmt.Printf("[*] Validators for committee #%d: %v\n", committee.Index, committee.Validators)
 
+	if detectSlashings {
+		var voters []common.ValidatorIndex
+		for i, valIndex := range committee.Validators {
+			if att.AggregationBits.GetBit(uint64(i)) {
+				voters = append(voters, valIndex)
+			}
+		}
+		observeVotes(&att.Data, voters, blockSlot)
+	}
+
+	record := attestationRecord{
+		slot:      att.Data.Slot,
+		committee: committee.Validators,
+		bits:      att.AggregationBits,
+		flags:     flags,
+	}
+	if currentBlock != nil && currentBlock.slot == blockSlot {
+		currentBlock.attestations = append(currentBlock.attestations, record)
+	}
+	applyAttestation(record, blockSlot)
+	return nil
+}
+
+// Register the validators of an attestation found in `blockSlot` with the
+// activity tracker
+func applyAttestation(att attestationRecord, blockSlot common.Slot) {
 	// Process validators in the committee sequentially and cross-reference
 	// them with the aggregated bitfield
-	for i, valIndex := range committee.Validators {
-		var is_present bool = att.AggregationBits.GetBit(uint64(i))
-		registerValidatorPresense(valIndex, att.Data.Slot, blockSlot, is_present)
+	for i, valIndex := range att.committee {
+		var is_present bool = att.bits.GetBit(uint64(i))
+		registerValidatorPresense(valIndex, att.slot, blockSlot, is_present, att.flags)
 	}
 }
 
-// Handle all the `attestations` of `blockSlot`
-func (ct *CommitteeTracker) HandleAttestations(attestations []phase0.Attestation, blockSlot common.Slot) {
+// Handle all the `attestations` of `blockSlot`. `flags[i]` are the
+// participation flags that `attestations[i]` earns.
+//
+// An attestation we can't handle does not stop us from handling the rest of
+// them. The first error we encountered is returned.
+func (ct *CommitteeTracker) HandleAttestations(attestations []phase0.Attestation, flags []int, blockSlot common.Slot) error {
+	startsNewEpoch := lastSlotSeen != 0 && ComputeEpochAtSlot(blockSlot) > ComputeEpochAtSlot(lastSlotSeen)
 	registerNewBlock(blockSlot)
 
-	for _, att := range attestations {
-		ct.handleAttestation(att, blockSlot)
+	var firstErr error
+	for i, att := range attestations {
+		if err := ct.handleAttestation(att, flags[i], blockSlot); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if detectSlashings {
+		if startsNewEpoch {
+			pruneReportedSlashings(ComputeEpochAtSlot(blockSlot))
+		}
+		if err := reportSlashings(); err != nil {
+			return err
+		}
 	}
+
+	// Now that the block is processed, persist the epochs it finished
+	finished, err := flushFinishedEpochs(blockSlot)
+	for _, epoch := range finished {
+		ct.evictEpoch(epoch)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Checkpoint once per epoch, so that we can resume from here
+	if startsNewEpoch {
+		if err := SaveCheckpoint(ct); err != nil {
+			return err
+		}
+	}
+
+	return firstErr
 }
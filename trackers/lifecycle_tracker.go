@@ -0,0 +1,133 @@
+/// This module keeps track of the lifecycle of validators: the deposits,
+/// voluntary exits and slashings found in blocks, and the status of the
+/// validators we saw missing. Their rows get annotated with their status, so
+/// that a validator that is not active anymore can be told apart from one that
+/// is offline (it counts as inactive rather than missing).
+
+package trackers
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Something that can tell us the status of validators
+type StatusSource interface {
+	// Statuses of `validators` at the end of `epoch`, as the beacon API
+	// calls them (e.g. "active_ongoing" or "exited_slashed")
+	ValidatorStatuses(epoch common.Epoch, validators []common.ValidatorIndex) (map[common.ValidatorIndex]string, error)
+}
+
+// Where we get statuses from (nil if we only go by the events we see)
+var statusSource StatusSource
+
+// Lifecycle events found in the blocks of the epochs we are tracking
+var lifecycleEvents = map[common.Slot][]db.LifecycleRow{}
+
+// What the events of the epochs we already flushed tell us about the status of
+// validators, for when `statusSource` can't
+var knownStatuses = map[common.ValidatorIndex]string{}
+
+// Look up the status of missing validators using `source`
+func InitLifecycleTracker(source StatusSource) {
+	statusSource = source
+}
+
+// Register the lifecycle `events` found in the block of `slot` (replacing any
+// we had for it)
+func RegisterLifecycleEvents(slot common.Slot, events []db.LifecycleRow) {
+	if len(events) == 0 {
+		delete(lifecycleEvents, slot)
+		return
+	}
+	lifecycleEvents[slot] = events
+	for _, e := range events {
+		metrics.LifecycleEvents.WithLabelValues(e.Kind).Inc()
+	}
+}
+
+// Forget the events of the blocks after `slot` (they got orphaned)
+func rollBackLifecycleEvents(slot common.Slot) {
+	for s := range lifecycleEvents {
+		if s > slot {
+			delete(lifecycleEvents, s)
+		}
+	}
+}
+
+// Return the lifecycle events of `epoch`
+func epochLifecycleEvents(epoch common.Epoch) []db.LifecycleRow {
+	var rows []db.LifecycleRow
+	for slot, events := range lifecycleEvents {
+		if SlotBelongsToEpoch(slot, epoch) {
+			rows = append(rows, events...)
+		}
+	}
+	return rows
+}
+
+// Stop tracking the lifecycle events of `epoch` (and of the epochs before it)
+func forgetLifecycleEvents(epoch common.Epoch) {
+	end := ComputeStartSlotAtEpoch(epoch + 1)
+	for slot := range lifecycleEvents {
+		if slot < end {
+			delete(lifecycleEvents, slot)
+		}
+	}
+}
+
+// Remember what `events` (of an epoch we are done with) tell us about the
+// status of validators
+func learnStatuses(events []db.LifecycleRow) {
+	for _, e := range events {
+		switch e.Kind {
+		case db.EventVoluntaryExit:
+			if knownStatuses[common.ValidatorIndex(e.ValidatorIdx)] == "" {
+				knownStatuses[common.ValidatorIndex(e.ValidatorIdx)] = "active_exiting"
+			}
+		case db.EventProposerSlashing, db.EventAttesterSlashing:
+			knownStatuses[common.ValidatorIndex(e.ValidatorIdx)] = "active_slashed"
+		}
+	}
+}
+
+// Return the status of the missing validators among `rows` (the rows of
+// `epoch` we are about to write), for the ones we know the status of
+func missingValidatorStatuses(epoch common.Epoch, rows []db.ActivityRow) map[common.ValidatorIndex]string {
+	var missing []common.ValidatorIndex
+	for _, row := range rows {
+		if row.Distance == VALIDATOR_MISSING_MAGIC {
+			missing = append(missing, common.ValidatorIndex(row.ValidatorIdx))
+		}
+	}
+
+	statuses := make(map[common.ValidatorIndex]string)
+	for _, validator := range missing {
+		if status, ok := knownStatuses[validator]; ok {
+			statuses[validator] = status
+		}
+	}
+
+	if statusSource == nil || len(missing) == 0 {
+		return statuses
+	}
+	fetched, err := statusSource.ValidatorStatuses(epoch, missing)
+	if err != nil {
+		fmt.Printf("[!] Failed to fetch validator statuses of epoch #%d: %v\n", epoch, err)
+		return statuses
+	}
+	for validator, status := range fetched {
+		statuses[validator] = status
+	}
+	return statuses
+}
+
+// Annotate `rows` with the status of their validators
+func applyStatuses(rows []db.ActivityRow, statuses map[common.ValidatorIndex]string) {
+	for i := range rows {
+		rows[i].ValidatorStatus = statuses[common.ValidatorIndex(rows[i].ValidatorIdx)]
+	}
+}
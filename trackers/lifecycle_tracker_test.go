@@ -0,0 +1,43 @@
+package trackers
+
+import (
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+func TestExitingValidatorsAreStillMissing(t *testing.T) {
+	resetJournalTest(t)
+	knownStatuses = map[common.ValidatorIndex]string{3: "active_exiting"}
+	t.Cleanup(func() { knownStatuses = map[common.ValidatorIndex]string{} })
+	committee := []common.ValidatorIndex{1, 2, 3, 4}
+
+	// Everyone but validator 4 misses the attestation: validator 3 is on its
+	// way out, but it still has the duty (and gets penalized for missing it)
+	processTestBlock(1, testAttestation(0, committee, 3))
+	if !interestingValidators[1] || !interestingValidators[2] || !interestingValidators[3] {
+		t.Fatalf("wrong interesting validators: %v", interestingValidators)
+	}
+
+	// The node tells us that validator 2 has exited: its row is annotated,
+	// not dropped
+	rows := []db.ActivityRow{
+		{ValidatorIdx: 1, Distance: VALIDATOR_MISSING_MAGIC, EffectiveDistance: VALIDATOR_MISSING_MAGIC},
+		{ValidatorIdx: 2, Distance: VALIDATOR_MISSING_MAGIC, EffectiveDistance: VALIDATOR_MISSING_MAGIC},
+		{ValidatorIdx: 4, Distance: 1, EffectiveDistance: 1},
+	}
+	applyStatuses(rows, map[common.ValidatorIndex]string{1: "active_slashed", 2: "exited_unslashed"})
+	for i, expected := range []string{"active_slashed", "exited_unslashed", ""} {
+		if rows[i].ValidatorStatus != expected {
+			t.Errorf("validator %d has status %q, expected %q", rows[i].ValidatorIdx, rows[i].ValidatorStatus, expected)
+		}
+	}
+	if !interestingValidators[2] || numInterestingValidators != 3 {
+		t.Errorf("validator 2 should still be interesting: %v", interestingValidators)
+	}
+	if db.DistanceStatus(rows[0].EffectiveDistance, rows[0].ValidatorStatus) != db.StatusMissing ||
+		db.DistanceStatus(rows[1].EffectiveDistance, rows[1].ValidatorStatus) != db.StatusInactive {
+		t.Errorf("validator 1 should be missing and validator 2 inactive: %+v", rows)
+	}
+}
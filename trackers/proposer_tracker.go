@@ -0,0 +1,86 @@
+/// This module keeps track of block proposals: who was supposed to propose in
+/// each slot, and whether the block made it into the chain, was never
+/// published (missed), or was published but left behind by the chain
+/// (orphaned). Proposals get written to the database along with the activity
+/// of their epoch.
+
+package trackers
+
+import (
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Who is supposed to propose in each slot of the epochs we are tracking,
+// according to the proposer duties
+var expectedProposers = map[common.Slot]common.ValidatorIndex{}
+
+// What happened to the proposal of each slot of the epochs we are tracking
+var proposals = map[common.Slot]*db.ProposalRow{}
+
+// Register the proposer duties of an epoch
+func RegisterProposerDuties(duties []eth2api.ProposerDuty) {
+	for _, duty := range duties {
+		expectedProposers[duty.Slot] = duty.ValidatorIndex
+	}
+}
+
+// Return the proposer that was expected at `slot`, or db.UnknownProposer
+func expectedProposer(slot common.Slot) int {
+	if proposer, ok := expectedProposers[slot]; ok {
+		return int(proposer)
+	}
+	return db.UnknownProposer
+}
+
+func recordProposal(slot common.Slot, proposer int, status string, root string) {
+	proposals[slot] = &db.ProposalRow{
+		Slot:        int(slot),
+		Epoch:       int(ComputeEpochAtSlot(slot)),
+		ProposerIdx: proposer,
+		Status:      status,
+		BlockRoot:   root,
+	}
+	metrics.Proposals.WithLabelValues(status).Inc()
+}
+
+// `proposer` published block `root` (whose parent is `parentRoot`) at `slot`.
+// Must be called before handling the sync aggregate and the attestations of
+// the block, which get journaled as the contributions of this block.
+//
+// Blocks that got orphaned are taken care of by RollBackBlocksAfter().
+func RegisterBlockProposal(slot common.Slot, proposer common.ValidatorIndex, root common.Root, parentRoot common.Root) {
+	// We may have given up on this slot before the block showed up
+	delete(emptySlots, slot)
+
+	journalBlock(slot, root, parentRoot, int(proposer))
+	recordProposal(slot, int(proposer), db.ProposalProposed, root.String())
+}
+
+// Return the proposals of `epoch` that we know of
+func epochProposals(epoch common.Epoch) []db.ProposalRow {
+	var rows []db.ProposalRow
+	for _, p := range proposals {
+		if p.Epoch == int(epoch) {
+			rows = append(rows, *p)
+		}
+	}
+	return rows
+}
+
+// Stop tracking the proposals of `epoch` (and of the epochs before it)
+func forgetProposals(epoch common.Epoch) {
+	end := ComputeStartSlotAtEpoch(epoch + 1)
+	for slot := range proposals {
+		if slot < end {
+			delete(proposals, slot)
+		}
+	}
+	for slot := range expectedProposers {
+		if slot < end {
+			delete(expectedProposers, slot)
+		}
+	}
+}
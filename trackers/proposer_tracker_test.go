@@ -0,0 +1,51 @@
+package trackers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+func TestProposalRows(t *testing.T) {
+	storage := resetFlushTest(t)
+	RegisterProposerDuties([]eth2api.ProposerDuty{{Slot: 4, ValidatorIndex: 10}, {Slot: 5, ValidatorIndex: 11}, {Slot: 6, ValidatorIndex: 12}})
+
+	// Slot 4 gets its block, slot 5 doesn't, and the block of slot 7 gets
+	// orphaned by a block of slot 8 built on the block of slot 6
+	RegisterBlockProposal(4, 10, common.Root{4}, common.Root{3})
+	RegisterEmptySlot(5)
+	RegisterBlockProposal(6, 12, common.Root{6}, common.Root{4})
+	RegisterBlockProposal(7, 13, common.Root{7}, common.Root{6})
+	if n := RollBackBlocksAfter(6); n != 1 {
+		t.Fatalf("rolled back %d blocks, expected 1", n)
+	}
+	RegisterBlockProposal(8, 14, common.Root{8}, common.Root{6})
+
+	// Nobody told us who should propose at slot 9
+	RegisterEmptySlot(9)
+
+	if _, err := flushEpoch(1); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(storage.proposals, func(i, j int) bool { return storage.proposals[i].Slot < storage.proposals[j].Slot })
+	expected := []db.ProposalRow{
+		{Slot: 4, Epoch: 1, ProposerIdx: 10, Status: db.ProposalProposed, BlockRoot: common.Root{4}.String()},
+		{Slot: 5, Epoch: 1, ProposerIdx: 11, Status: db.ProposalMissed},
+		{Slot: 6, Epoch: 1, ProposerIdx: 12, Status: db.ProposalProposed, BlockRoot: common.Root{6}.String()},
+		{Slot: 7, Epoch: 1, ProposerIdx: 13, Status: db.ProposalOrphaned, BlockRoot: common.Root{7}.String()},
+	}
+	if !reflect.DeepEqual(storage.proposals, expected) {
+		t.Errorf("got proposals %+v, expected %+v", storage.proposals, expected)
+	}
+
+	proposals := epochProposals(2)
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].Slot < proposals[j].Slot })
+	if len(proposals) != 2 || proposals[0].Status != db.ProposalProposed ||
+		proposals[1].Status != db.ProposalMissed || proposals[1].ProposerIdx != db.UnknownProposer {
+		t.Errorf("wrong proposals of epoch 2: %+v", proposals)
+	}
+}
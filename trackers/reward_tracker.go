@@ -0,0 +1,47 @@
+/// This module attaches the balances and the rewards of the validators we
+/// store to their activity. Figuring out the rewards takes the beacon node
+/// (see RewardSource), so this is opt-in.
+
+package trackers
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Something that can tell us the balances and the rewards of validators
+type RewardSource interface {
+	// Balances and rewards of `validators` in `epoch`. `blocks` are the
+	// proposals of the epoch, so that the source can attribute block rewards.
+	EpochRewards(epoch common.Epoch, validators []common.ValidatorIndex, blocks []db.ProposalRow) ([]db.RewardRow, error)
+}
+
+// Where we get rewards from (nil if we don't track them)
+var rewardSource RewardSource
+
+// Also track the balances and rewards of the validators we store, using `source`
+func InitRewardTracker(source RewardSource) {
+	rewardSource = source
+}
+
+// Store the balances and rewards of `rows` (the activity of `epoch` we are
+// about to store). Failing to get them is not fatal: we just don't store any.
+func registerEpochRewards(epoch common.Epoch, rows []db.ActivityRow, blocks []db.ProposalRow) error {
+	if rewardSource == nil || len(rows) == 0 {
+		return nil
+	}
+
+	validators := make([]common.ValidatorIndex, 0, len(rows))
+	for _, row := range rows {
+		validators = append(validators, common.ValidatorIndex(row.ValidatorIdx))
+	}
+
+	rewards, err := rewardSource.EpochRewards(epoch, validators, blocks)
+	if err != nil {
+		fmt.Printf("[!] Failed to fetch rewards of epoch #%d: %v\n", epoch, err)
+		return nil
+	}
+	return activityDB.RegisterRewards(rewards)
+}
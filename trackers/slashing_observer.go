@@ -0,0 +1,228 @@
+/// This module looks for slashable attestations on chain: a validator voting
+/// for two different things with the same target (double vote), or with one
+/// vote surrounding the other (surround vote). It keeps a compact history of
+/// the votes of every validator we see attesting: one vote per target epoch,
+/// for a limited number of epochs, in a ring of fixed size per validator.
+/// Findings go to the database and to an alert stream.
+
+package trackers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// A vote of a validator, as compact as we can make it. The target epoch is
+// the epoch of the slot.
+type vote struct {
+	slot      uint32
+	source    uint32
+	blockSlot uint32 // where we saw it (zero for no vote: no block can include a vote at slot zero)
+	digest    uint32 // of the whole attestation data
+}
+
+func (v *vote) target() uint32 {
+	return uint32(ComputeEpochAtSlot(common.Slot(v.slot)))
+}
+
+// Whether we look for slashable attestations at all
+var detectSlashings bool
+
+// How many epochs of votes we keep per validator
+var slashingHistoryEpochs common.Epoch
+
+// Where we write alerts to (nil for nowhere)
+var slashingAlerts io.Writer
+
+// How many validators share a page of the vote history
+const votePageValidators = 4096
+
+// The votes we saw of every validator, by pages of votePageValidators. Each
+// validator gets slashingHistoryEpochs votes in its page, with the vote of
+// target epoch `e` at `e % slashingHistoryEpochs`. Pages get allocated when
+// we first see one of their validators, and never grow after that.
+var voteHistory [][]vote
+
+// Slashable attestations we found in the block we are handling
+var pendingSlashings []db.SlashingRow
+
+// What identifies a slashable pair of votes (like the key of slashable_votes)
+type slashingKey struct {
+	validator        common.ValidatorIndex
+	kind             string
+	source1, target1 uint32
+	source2, target2 uint32
+}
+
+// The slashable pairs we reported already, so that we report each just once
+var reportedSlashings = map[slashingKey]bool{}
+
+// Look for slashable attestations, checking new votes against the votes of the
+// last `historyEpochs` epochs, and write alerts to `alerts` (if not nil)
+func InitSlashingObserver(historyEpochs int, alerts io.Writer) {
+	detectSlashings = true
+	slashingHistoryEpochs = common.Epoch(historyEpochs)
+	slashingAlerts = alerts
+	voteHistory = nil
+}
+
+// Return the ring of votes of `validator`
+func validatorVotes(validator common.ValidatorIndex) []vote {
+	page := int(validator / votePageValidators)
+	for len(voteHistory) <= page {
+		voteHistory = append(voteHistory, nil)
+	}
+	if voteHistory[page] == nil {
+		voteHistory[page] = make([]vote, votePageValidators*int(slashingHistoryEpochs))
+	}
+	start := int(validator%votePageValidators) * int(slashingHistoryEpochs)
+	return voteHistory[page][start : start+int(slashingHistoryEpochs)]
+}
+
+// Digest of the attestation data `data`. Two votes with the same target are
+// a double vote if their digests differ.
+func voteDigest(data *phase0.AttestationData) uint32 {
+	h := fnv.New32a()
+	var buf [8]byte
+	for _, n := range []uint64{uint64(data.Slot), uint64(data.Index), uint64(data.Source.Epoch), uint64(data.Target.Epoch)} {
+		binary.LittleEndian.PutUint64(buf[:], n)
+		h.Write(buf[:])
+	}
+	h.Write(data.BeaconBlockRoot[:])
+	h.Write(data.Source.Root[:])
+	h.Write(data.Target.Root[:])
+	return h.Sum32()
+}
+
+// Check the votes of `validators` for `data` (found in `blockSlot`) against
+// their history, and add them to it
+func observeVotes(data *phase0.AttestationData, validators []common.ValidatorIndex, blockSlot common.Slot) {
+	v := vote{
+		slot:      uint32(data.Slot),
+		source:    uint32(data.Source.Epoch),
+		blockSlot: uint32(blockSlot),
+		digest:    voteDigest(data),
+	}
+	for _, validator := range validators {
+		observeVote(validator, v)
+	}
+}
+
+func observeVote(validator common.ValidatorIndex, v vote) {
+	history := validatorVotes(validator)
+	own := &history[v.target()%uint32(slashingHistoryEpochs)]
+	if own.blockSlot != 0 && own.target() == v.target() && own.digest == v.digest {
+		return // seen already (e.g. in another aggregate)
+	}
+
+	for i := range history {
+		if history[i].blockSlot == 0 {
+			continue
+		}
+		if kind := conflict(&history[i], &v); kind != "" {
+			recordSlashing(validator, kind, &history[i], &v)
+		}
+	}
+
+	// Keep the first vote we saw for each target, over the votes of the
+	// targets that are too old to be checked against anymore
+	if own.blockSlot == 0 || own.target() < v.target() {
+		*own = v
+	}
+}
+
+// Return what kind of slashable pair `a` and `b` make (empty if none)
+func conflict(a *vote, b *vote) string {
+	switch {
+	case a.target() == b.target():
+		return db.SlashableDoubleVote
+	case a.source < b.source && b.target() < a.target(), b.source < a.source && a.target() < b.target():
+		return db.SlashableSurroundVote
+	}
+	return ""
+}
+
+// A slashable attestation, as written to the alert stream
+type slashingAlert struct {
+	Kind         string      `json:"kind"`
+	ValidatorIdx int         `json:"validator_idx"`
+	Votes        []alertVote `json:"votes"`
+}
+
+type alertVote struct {
+	Slot      int `json:"slot"`
+	Source    int `json:"source"`
+	Target    int `json:"target"`
+	BlockSlot int `json:"block_slot"`
+}
+
+func recordSlashing(validator common.ValidatorIndex, kind string, first *vote, second *vote) {
+	key := slashingKey{validator, kind, first.source, first.target(), second.source, second.target()}
+	if reportedSlashings[key] {
+		return
+	}
+	reportedSlashings[key] = true
+
+	row := db.SlashingRow{
+		ValidatorIdx: int(validator),
+		Kind:         kind,
+		Slot1:        int(first.slot),
+		Source1:      int(first.source),
+		Target1:      int(first.target()),
+		BlockSlot1:   int(first.blockSlot),
+		Slot2:        int(second.slot),
+		Source2:      int(second.source),
+		Target2:      int(second.target()),
+		BlockSlot2:   int(second.blockSlot),
+	}
+	fmt.Printf("[!] Slashable %s by validator #%d: %d->%d (block #%d) vs %d->%d (block #%d)\n", kind, validator,
+		row.Source1, row.Target1, row.BlockSlot1, row.Source2, row.Target2, row.BlockSlot2)
+	metrics.SlashableVotes.WithLabelValues(kind).Inc()
+	pendingSlashings = append(pendingSlashings, row)
+}
+
+// Store the slashable attestations we found and send out their alerts
+func reportSlashings() error {
+	if len(pendingSlashings) == 0 {
+		return nil
+	}
+	rows := pendingSlashings
+	pendingSlashings = nil
+
+	if slashingAlerts != nil {
+		enc := json.NewEncoder(slashingAlerts)
+		for _, row := range rows {
+			alert := slashingAlert{Kind: row.Kind, ValidatorIdx: row.ValidatorIdx, Votes: []alertVote{
+				{Slot: row.Slot1, Source: row.Source1, Target: row.Target1, BlockSlot: row.BlockSlot1},
+				{Slot: row.Slot2, Source: row.Source2, Target: row.Target2, BlockSlot: row.BlockSlot2},
+			}}
+			if err := enc.Encode(alert); err != nil {
+				fmt.Printf("[!] Failed to write slashing alert: %v\n", err)
+			}
+		}
+	}
+	return activityDB.RegisterSlashings(rows)
+}
+
+// Forget the slashings we reported whose votes are too old to be checked
+// against anymore, now that we are at `epoch` (the vote history makes room for
+// new votes by itself)
+func pruneReportedSlashings(epoch common.Epoch) {
+	if epoch < slashingHistoryEpochs {
+		return
+	}
+	oldest := uint32(epoch - slashingHistoryEpochs)
+	for key := range reportedSlashings {
+		if key.target1 < oldest && key.target2 < oldest {
+			delete(reportedSlashings, key)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package trackers
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// A vote from `source` to `target` (at the first slot of the target epoch)
+func testVote(source, target uint32) *vote {
+	return &vote{slot: uint32(ComputeStartSlotAtEpoch(common.Epoch(target))), source: source}
+}
+
+func TestConflict(t *testing.T) {
+	for _, test := range []struct {
+		a, b     *vote
+		expected string
+	}{
+		{testVote(1, 3), testVote(2, 3), db.SlashableDoubleVote},
+		{testVote(1, 5), testVote(2, 4), db.SlashableSurroundVote},
+		{testVote(2, 4), testVote(1, 5), db.SlashableSurroundVote},
+		{testVote(1, 2), testVote(2, 3), ""}, // one after the other
+		{testVote(1, 3), testVote(2, 4), ""}, // overlapping
+		{testVote(1, 5), testVote(1, 4), ""}, // same source
+		{testVote(1, 5), testVote(2, 5), db.SlashableDoubleVote},
+		{testVote(1, 4), testVote(2, 5), ""},
+	} {
+		if kind := conflict(test.a, test.b); kind != test.expected {
+			t.Errorf("%d->%d vs %d->%d: got %q, expected %q", test.a.source, test.a.target(),
+				test.b.source, test.b.target(), kind, test.expected)
+		}
+	}
+}
+
+func testAttestationData(slot common.Slot, source common.Epoch, root byte) *phase0.AttestationData {
+	return &phase0.AttestationData{
+		Slot:            slot,
+		BeaconBlockRoot: common.Root{root},
+		Source:          common.Checkpoint{Epoch: source},
+		Target:          common.Checkpoint{Epoch: ComputeEpochAtSlot(slot)},
+	}
+}
+
+// Start from an empty vote history of `historyEpochs` epochs
+func resetSlashingTest(t *testing.T, historyEpochs common.Epoch) {
+	slashingHistoryEpochs = historyEpochs
+	voteHistory = nil
+	reportedSlashings = map[slashingKey]bool{}
+	pendingSlashings = nil
+	t.Cleanup(func() {
+		slashingHistoryEpochs = 0
+		voteHistory = nil
+		reportedSlashings = map[slashingKey]bool{}
+		pendingSlashings = nil
+	})
+}
+
+func TestObserveVotes(t *testing.T) {
+	resetSlashingTest(t, 64)
+	validators := []common.ValidatorIndex{1, 2}
+
+	// The same vote in two aggregates is no double vote
+	observeVotes(testAttestationData(96, 2, 0xaa), validators, 97)
+	observeVotes(testAttestationData(96, 2, 0xaa), validators, 98)
+	if len(pendingSlashings) != 0 {
+		t.Fatalf("found slashings in the same vote: %+v", pendingSlashings)
+	}
+
+	// Validator 1 votes for another head in the same epoch, twice
+	observeVotes(testAttestationData(97, 2, 0xbb), validators[:1], 99)
+	observeVotes(testAttestationData(97, 2, 0xbb), validators[:1], 100)
+	if len(pendingSlashings) != 1 || pendingSlashings[0].Kind != db.SlashableDoubleVote || pendingSlashings[0].ValidatorIdx != 1 {
+		t.Fatalf("expected a double vote by validator 1: %+v", pendingSlashings)
+	}
+
+	// Validator 2 surrounds its vote from 2 to 3
+	observeVotes(testAttestationData(160, 1, 0xcc), validators[1:], 161)
+	if len(pendingSlashings) != 2 {
+		t.Fatalf("expected a surround vote by validator 2: %+v", pendingSlashings)
+	}
+	row := pendingSlashings[1]
+	if row.Kind != db.SlashableSurroundVote || row.ValidatorIdx != 2 || row.Source1 != 2 || row.Target1 != 3 ||
+		row.Source2 != 1 || row.Target2 != 5 || row.BlockSlot2 != 161 {
+		t.Errorf("wrong surround vote: %+v", row)
+	}
+}
+
+func TestVoteHistoryWraps(t *testing.T) {
+	resetSlashingTest(t, 4)
+
+	// Votes from 1 to 2, then one per epoch for longer than the history
+	observeVote(1, vote{slot: uint32(ComputeStartSlotAtEpoch(2)), source: 1, blockSlot: 1, digest: 1})
+	for target := uint32(3); target < 10; target++ {
+		observeVote(1, vote{slot: uint32(ComputeStartSlotAtEpoch(common.Epoch(target))), source: target - 1, blockSlot: 1, digest: target})
+	}
+	if len(pendingSlashings) != 0 {
+		t.Fatalf("found slashings in honest votes: %+v", pendingSlashings)
+	}
+
+	// A double vote within the history is caught
+	observeVote(1, vote{slot: uint32(ComputeStartSlotAtEpoch(8)), source: 7, blockSlot: 1, digest: 100})
+	if len(pendingSlashings) != 1 || pendingSlashings[0].Kind != db.SlashableDoubleVote || pendingSlashings[0].Target1 != 8 {
+		t.Errorf("expected a double vote with target 8: %+v", pendingSlashings)
+	}
+}
+
+func TestVoteHistoryMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("observes a million validators")
+	}
+	// About the number of validators of mainnet
+	const validators = 1 << 20
+	const historyEpochs = 4
+	resetSlashingTest(t, historyEpochs)
+
+	heap := func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+	observeEpoch := func(target uint32) {
+		slot := uint32(ComputeStartSlotAtEpoch(common.Epoch(target)))
+		for validator := common.ValidatorIndex(0); validator < validators; validator++ {
+			observeVote(validator, vote{slot: slot, source: target - 1, blockSlot: slot + 1, digest: target})
+		}
+	}
+
+	before := heap()
+	for target := uint32(1); target <= historyEpochs; target++ {
+		observeEpoch(target)
+	}
+	full := heap()
+	for target := uint32(historyEpochs + 1); target <= 3*historyEpochs; target++ {
+		observeEpoch(target)
+	}
+	after := heap()
+
+	expected := uint64(validators * historyEpochs * unsafe.Sizeof(vote{}))
+	if full-before > expected+expected/10 {
+		t.Errorf("the history of %d validators over %d epochs takes %d bytes, expected about %d", validators, historyEpochs, full-before, expected)
+	}
+	if after > full+expected/100 {
+		t.Errorf("the history grew from %d to %d bytes after it was full", full, after)
+	}
+	if len(pendingSlashings) != 0 {
+		t.Errorf("found %d slashings in honest votes", len(pendingSlashings))
+	}
+}
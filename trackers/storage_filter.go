@@ -0,0 +1,68 @@
+/// This module decides which validators are interesting enough to be written
+/// to validator_state. Interesting validators get their activity stored for
+/// every epoch from then on, so that the swimlane shows what they were doing
+/// before and after.
+
+package trackers
+
+import (
+	"fmt"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// The filter policies we know about
+const (
+	FilterSlowOrMissing = "slow-or-missing"
+	FilterAll           = "all"
+	FilterSlow          = "slow"
+	FilterMissing       = "missing"
+	FilterWatchlist     = "watchlist"
+)
+
+// Decides whether a validator is interesting
+type StorageFilter interface {
+	// We just saw `validator` with `state` (an inclusion distance or
+	// VALIDATOR_MISSING_MAGIC). Does that make it interesting?
+	IsInteresting(validator common.ValidatorIndex, state int) bool
+}
+
+// A StorageFilter made out of a plain function
+type filterFunc func(validator common.ValidatorIndex, state int) bool
+
+func (f filterFunc) IsInteresting(validator common.ValidatorIndex, state int) bool {
+	return f(validator, state)
+}
+
+func isSlow(state int) bool {
+	return state > 1 && state != VALIDATOR_MISSING_MAGIC
+}
+
+// Only validators in `watchlist` are interesting, whatever they do
+type watchlistFilter map[common.ValidatorIndex]bool
+
+func (w watchlistFilter) IsInteresting(validator common.ValidatorIndex, state int) bool {
+	return w[validator]
+}
+
+// Make the filter policy called `name`. `watchlist` is only used by the
+// watchlist policy.
+func NewStorageFilter(name string, watchlist []int) (StorageFilter, error) {
+	switch name {
+	case FilterSlowOrMissing:
+		return filterFunc(func(_ common.ValidatorIndex, state int) bool { return state > 1 }), nil
+	case FilterAll:
+		return filterFunc(func(common.ValidatorIndex, int) bool { return true }), nil
+	case FilterSlow:
+		return filterFunc(func(_ common.ValidatorIndex, state int) bool { return isSlow(state) }), nil
+	case FilterMissing:
+		return filterFunc(func(_ common.ValidatorIndex, state int) bool { return state == VALIDATOR_MISSING_MAGIC }), nil
+	case FilterWatchlist:
+		w := watchlistFilter{}
+		for _, validator := range watchlist {
+			w[common.ValidatorIndex(validator)] = true
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("unknown storage filter %q", name)
+}
@@ -0,0 +1,126 @@
+/// This module tracks sync committees and correlates them with the sync
+/// aggregates of blocks, just like the committee tracker does with
+/// attestations. Participation gets written to the database along with the
+/// activity of its epoch.
+
+package trackers
+
+import (
+	"fmt"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/asn-d6/visit/metrics"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Tracks the sync committees of the periods we are looking at
+type SyncCommitteeTracker struct {
+	// { Period #123 : [ Validator #5, Validator #1024, ... ] } (the position
+	// of a validator is the bit of the sync aggregate that speaks for it)
+	tracker map[uint64][]common.ValidatorIndex
+}
+
+func InitSyncCommitteeTracker() *SyncCommitteeTracker {
+	return &SyncCommitteeTracker{tracker: make(map[uint64][]common.ValidatorIndex)}
+}
+
+// Register the sync committee of `period`, and forget about the ones we won't
+// need anymore
+func (st *SyncCommitteeTracker) RegisterSyncCommittee(period uint64, validators []common.ValidatorIndex) {
+	fmt.Printf("\tGot fresh sync committee info: registering %d validators for period #%d\n", len(validators), period)
+	st.tracker[period] = validators
+	for p := range st.tracker {
+		if p+1 < period {
+			delete(st.tracker, p)
+		}
+	}
+}
+
+// Check whether we are tracking the sync committee in charge at `epoch`
+func (st *SyncCommitteeTracker) SyncCommitteeIsKnownForEpoch(epoch common.Epoch) bool {
+	return st.tracker[ComputeSyncCommitteePeriod(epoch)] != nil
+}
+
+// Return the sync committee in charge at `epoch` (nil if we are not tracking it)
+func (st *SyncCommitteeTracker) SyncCommitteeOfEpoch(epoch common.Epoch) []common.ValidatorIndex {
+	return st.tracker[ComputeSyncCommitteePeriod(epoch)]
+}
+
+// A sync aggregate referenced a sync committee we are not tracking
+type UnknownSyncCommitteeError struct {
+	Period uint64
+}
+
+func (e *UnknownSyncCommitteeError) Error() string {
+	return fmt.Sprintf("unknown sync committee for period #%d", e.Period)
+}
+
+// Tracks how the members of the sync committee did per epoch
+//
+// { Epoch #123123 : { Validator #1 : {participated: 31, missed: 1, ...}, ... } }
+var syncParticipationTracker = map[common.Epoch]map[common.ValidatorIndex]*db.SyncRow{}
+
+// Handle the sync aggregate (`bits`) of the block at `blockSlot`. Must be
+// called before handling the attestations of the block.
+//
+// Like in the spec, the committee in charge is the one of the epoch of the
+// block, and participation counts towards that epoch (even though members
+// signed the block of the slot before).
+func (st *SyncCommitteeTracker) HandleSyncAggregate(blockSlot common.Slot, bits altair.SyncCommitteeBits) error {
+	epoch := ComputeEpochAtSlot(blockSlot)
+	period := ComputeSyncCommitteePeriod(epoch)
+	committee := st.tracker[period]
+	if committee == nil {
+		return &UnknownSyncCommitteeError{Period: period}
+	}
+
+	if currentBlock != nil && currentBlock.slot == blockSlot {
+		currentBlock.syncBits = bits
+		currentBlock.syncCommittee = committee
+	}
+	applySyncAggregate(blockSlot, committee, bits)
+	return nil
+}
+
+// Register the participation of the members of `committee` in the sync
+// aggregate (`bits`) of the block at `blockSlot`
+func applySyncAggregate(blockSlot common.Slot, committee []common.ValidatorIndex, bits altair.SyncCommitteeBits) {
+	epoch := ComputeEpochAtSlot(blockSlot)
+	if syncParticipationTracker[epoch] == nil {
+		syncParticipationTracker[epoch] = make(map[common.ValidatorIndex]*db.SyncRow)
+	}
+	participation := syncParticipationTracker[epoch]
+
+	slotBit := int64(1) << uint(ComputeSlotIndexWithinEpoch(blockSlot))
+	for i, valIndex := range committee {
+		row := participation[valIndex]
+		if row == nil {
+			row = &db.SyncRow{ValidatorIdx: int(valIndex), Epoch: int(epoch)}
+			participation[valIndex] = row
+		}
+
+		if bits.GetBit(uint64(i)) {
+			row.Participated++
+		} else {
+			row.Missed++
+			row.MissedSlots |= slotBit
+		}
+	}
+}
+
+// Return the sync committee participation of `epoch`, and report it
+func epochSyncRows(epoch common.Epoch) []db.SyncRow {
+	var rows []db.SyncRow
+	var participated, missed int
+	for _, row := range syncParticipationTracker[epoch] {
+		rows = append(rows, *row)
+		participated += row.Participated
+		missed += row.Missed
+	}
+
+	if participated+missed > 0 {
+		metrics.EpochSyncParticipationRate.Set(float64(participated) / float64(participated+missed))
+	}
+	return rows
+}
@@ -0,0 +1,68 @@
+package trackers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// The sync aggregate of a committee of `size`, without the signatures of the
+// members at `missing`
+func testSyncBits(size int, missing ...int) altair.SyncCommitteeBits {
+	bits := make(altair.SyncCommitteeBits, (size+7)/8)
+	for i := 0; i < size; i++ {
+		bits.SetBit(uint64(i), true)
+	}
+	for _, i := range missing {
+		bits.SetBit(uint64(i), false)
+	}
+	return bits
+}
+
+func TestSyncMissedSlots(t *testing.T) {
+	storage := resetFlushTest(t)
+	st := InitSyncCommitteeTracker()
+	st.RegisterSyncCommittee(ComputeSyncCommitteePeriod(1), []common.ValidatorIndex{20, 21, 22})
+
+	// Validator 20 signs every block, validator 21 misses the blocks of slots
+	// 4 and 6, validator 22 the ones of slots 6 and 7. Slot 5 has no block.
+	for _, block := range []struct {
+		slot    common.Slot
+		missing []int
+	}{{4, []int{1}}, {6, []int{1, 2}}, {7, []int{2}}} {
+		RegisterBlockProposal(block.slot, 0, common.Root{byte(block.slot)}, common.Root{})
+		if err := st.HandleSyncAggregate(block.slot, testSyncBits(3, block.missing...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RegisterEmptySlot(5)
+
+	if _, err := flushEpoch(1); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(storage.sync, func(i, j int) bool { return storage.sync[i].ValidatorIdx < storage.sync[j].ValidatorIdx })
+	expected := []db.SyncRow{
+		{ValidatorIdx: 20, Epoch: 1, Participated: 3},
+		{ValidatorIdx: 21, Epoch: 1, Participated: 1, Missed: 2, MissedSlots: 1<<0 | 1<<2},
+		{ValidatorIdx: 22, Epoch: 1, Participated: 1, Missed: 2, MissedSlots: 1<<2 | 1<<3},
+	}
+	if !reflect.DeepEqual(storage.sync, expected) {
+		t.Errorf("got %+v, expected %+v", storage.sync, expected)
+	}
+}
+
+func TestSyncAggregateOfUnknownCommittee(t *testing.T) {
+	resetJournalTest(t)
+	st := InitSyncCommitteeTracker()
+	st.RegisterSyncCommittee(0, []common.ValidatorIndex{20})
+
+	slot := ComputeStartSlotAtEpoch(epochsPerSyncCommitteePeriod)
+	err := st.HandleSyncAggregate(slot, testSyncBits(1))
+	if _, ok := err.(*UnknownSyncCommitteeError); !ok {
+		t.Errorf("expected an UnknownSyncCommitteeError, got %v", err)
+	}
+}
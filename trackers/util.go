@@ -2,9 +2,23 @@ package trackers
 
 import "github.com/protolambda/zrnt/eth2/beacon/common"
 
+// SLOTS_PER_EPOCH of the network we are looking at (mainnet by default)
+var slotsPerEpoch common.Slot = 32
+
+// EPOCHS_PER_SYNC_COMMITTEE_PERIOD of the network we are looking at
+var epochsPerSyncCommitteePeriod common.Epoch = 256
+
+// Make the helpers below follow `spec`
+func InitSpec(spec *common.Spec) {
+	slotsPerEpoch = spec.SLOTS_PER_EPOCH
+	if spec.EPOCHS_PER_SYNC_COMMITTEE_PERIOD != 0 { // pre-altair configs don't have it
+		epochsPerSyncCommitteePeriod = spec.EPOCHS_PER_SYNC_COMMITTEE_PERIOD
+	}
+}
+
 // Helper function from the friendly spec
 func ComputeEpochAtSlot(slot common.Slot) common.Epoch {
-	return common.Epoch(slot / 32)
+	return common.Epoch(slot / slotsPerEpoch)
 }
 
 // Helper function from the friendly spec
@@ -16,7 +30,12 @@ func SlotBelongsToEpoch(slot common.Slot, epoch common.Epoch) bool {
 }
 
 func ComputeStartSlotAtEpoch(epoch common.Epoch) common.Slot {
-	return common.Slot(epoch * 32)
+	return common.Slot(epoch) * slotsPerEpoch
+}
+
+// Helper function from the friendly spec
+func ComputeSyncCommitteePeriod(epoch common.Epoch) uint64 {
+	return uint64(epoch / epochsPerSyncCommitteePeriod)
 }
 
 func ComputeSlotIndexWithinEpoch(slot common.Slot) int {
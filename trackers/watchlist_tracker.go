@@ -0,0 +1,83 @@
+/// This module keeps an eye on the validators of the watchlist: they always
+/// get stored, whatever they do, and so does the full detail of their duties
+/// (where they were supposed to attest, and which block included them).
+
+package trackers
+
+import (
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// The validators we are watching
+var watchlist = map[common.ValidatorIndex]bool{}
+
+// Where the watched validators are supposed to attest, per epoch. Filled in
+// from the committees as we learn about them.
+//
+// { Epoch #123123 : { Validator #1 : {slot: 3938, committee: 12, position: 71}, ... } }
+var watchedAssignments = map[common.Epoch]map[common.ValidatorIndex]*db.WatchDutyRow{}
+
+// Watch `validators`
+func InitWatchlist(validators []int) {
+	watchlist = make(map[common.ValidatorIndex]bool, len(validators))
+	for _, validator := range validators {
+		watchlist[common.ValidatorIndex(validator)] = true
+	}
+}
+
+// Remember where the watched validators of `committees` are supposed to attest
+func registerWatchedAssignments(committees []eth2api.Committee) {
+	if len(watchlist) == 0 {
+		return
+	}
+	for _, c := range committees {
+		epoch := ComputeEpochAtSlot(c.Slot)
+		for position, validator := range c.Validators {
+			if !watchlist[validator] {
+				continue
+			}
+			if watchedAssignments[epoch] == nil {
+				watchedAssignments[epoch] = make(map[common.ValidatorIndex]*db.WatchDutyRow)
+			}
+			watchedAssignments[epoch][validator] = &db.WatchDutyRow{
+				ValidatorIdx:   int(validator),
+				Epoch:          int(epoch),
+				Slot:           int(c.Slot),
+				CommitteeIndex: int(c.Index),
+				Position:       position,
+			}
+		}
+	}
+}
+
+// Return the duties of the watched validators in `epoch`. Validators whose
+// attestation never made it into a block are missing, even if no block
+// carried an attestation of their committee.
+func epochWatchDuties(epoch common.Epoch) []db.WatchDutyRow {
+	var rows []db.WatchDutyRow
+	for validator, assignment := range watchedAssignments[epoch] {
+		row := *assignment
+		row.Distance = VALIDATOR_MISSING_MAGIC
+		row.EffectiveDistance = VALIDATOR_MISSING_MAGIC
+		row.InclusionSlot = -1
+		if distance, ok := validatorActivityTracker[epoch][validator]; ok && distance != VALIDATOR_MISSING_MAGIC {
+			row.Distance = distance
+			row.EffectiveDistance = validatorEffectiveTracker[epoch][validator]
+			row.InclusionSlot = row.Slot + distance
+		}
+		row.Flags = validatorFlagsTracker[epoch][validator]
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Stop tracking the assignments of `epoch` (and of the epochs before it)
+func forgetWatchedAssignments(epoch common.Epoch) {
+	for e := range watchedAssignments {
+		if e <= epoch {
+			delete(watchedAssignments, e)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package trackers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/asn-d6/visit/db"
+	"github.com/protolambda/eth2api"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+func TestWatchlistDuties(t *testing.T) {
+	storage := resetFlushTest(t)
+	InitWatchlist([]int{30, 31, 32})
+	watchedAssignments = map[common.Epoch]map[common.ValidatorIndex]*db.WatchDutyRow{}
+	t.Cleanup(func() { InitWatchlist(nil) })
+
+	// Validator 30 gets included two slots late and validator 31 not at all.
+	// No block carries an attestation of the committee of validator 32.
+	committee := []common.ValidatorIndex{30, 40, 31}
+	registerWatchedAssignments([]eth2api.Committee{
+		{Slot: 4, Index: 0, Validators: committee},
+		{Slot: 5, Index: 1, Validators: []common.ValidatorIndex{41, 32}},
+	})
+	processTestBlock(5)
+	processTestBlock(6, testAttestation(4, committee, 0, 1))
+	if _, err := flushEpoch(1); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(storage.watchDuties, func(i, j int) bool {
+		return storage.watchDuties[i].ValidatorIdx < storage.watchDuties[j].ValidatorIdx
+	})
+	expected := []db.WatchDutyRow{
+		{ValidatorIdx: 30, Epoch: 1, Slot: 4, CommitteeIndex: 0, Position: 0, InclusionSlot: 6, Distance: 2, EffectiveDistance: 2, Flags: TIMELY_SOURCE_FLAG},
+		{ValidatorIdx: 31, Epoch: 1, Slot: 4, CommitteeIndex: 0, Position: 2, InclusionSlot: -1, Distance: VALIDATOR_MISSING_MAGIC, EffectiveDistance: VALIDATOR_MISSING_MAGIC},
+		{ValidatorIdx: 32, Epoch: 1, Slot: 5, CommitteeIndex: 1, Position: 1, InclusionSlot: -1, Distance: VALIDATOR_MISSING_MAGIC, EffectiveDistance: VALIDATOR_MISSING_MAGIC},
+	}
+	if !reflect.DeepEqual(storage.watchDuties, expected) {
+		t.Errorf("got %+v, expected %+v", storage.watchDuties, expected)
+	}
+
+	// Watched validators get written to validator_state even when they did
+	// fine, unlike the rest
+	stored := map[int]bool{}
+	for _, row := range storage.activity {
+		stored[row.ValidatorIdx] = true
+	}
+	if !stored[30] || !stored[31] || stored[40] {
+		t.Errorf("wrong validators written to validator_state: %+v", storage.activity)
+	}
+	if len(watchedAssignments) != 0 {
+		t.Errorf("the assignments of epoch 1 are still around: %v", watchedAssignments)
+	}
+}
@@ -0,0 +1,11 @@
+/// The assets of the swimlane visualization, so that `visit serve` can serve
+/// them without needing this directory around.
+
+package visualize_d3
+
+import (
+	"embed"
+)
+
+//go:embed index.html style.css
+var Assets embed.FS
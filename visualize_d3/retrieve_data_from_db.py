@@ -5,10 +5,10 @@ import math
 
 VALS_PER_JSON = 1000
 
-def get_validators(db, range_start, range_end):
-    """Get validators (ordered by validator index) from 'range_start' to 'range_end'"""
-    rows = db.execute("""SELECT * from validator_state ORDER BY validator_idx LIMIT %d OFFSET %d"""
-                      % (range_end, range_start)).fetchall()
+def get_validators(db, first_validator, last_validator):
+    """Get the entries of validators 'first_validator' to 'last_validator' (inclusive, ordered by validator index)"""
+    rows = db.execute("""SELECT * from validator_state WHERE validator_idx BETWEEN ? AND ? ORDER BY validator_idx, epoch""",
+                      (first_validator, last_validator)).fetchall()
 
     return json.dumps( [dict(ix) for ix in rows] ) #CREATE JSON
 
@@ -25,23 +25,28 @@ db.execute("SELECT COUNT(DISTINCT epoch) FROM validator_state")
 epochs = db.fetchone()[0]
 db.execute("SELECT COUNT(*) FROM validator_state")
 total_entries = db.fetchone()[0]
-assert(total_entries == epochs * n_validators) # sanity check
+# Not every validator has an entry for every epoch (e.g. validators become
+# interesting halfway through, or were never seen in a committee), so don't
+# expect total_entries == epochs * n_validators
+if total_entries != epochs * n_validators:
+    print("Sparse data: %d entries for %d validators over %d epochs" % (total_entries, n_validators, epochs))
+
+validators = [row[0] for row in db.execute("SELECT DISTINCT validator_idx FROM validator_state ORDER BY validator_idx").fetchall()]
 
 n_jsons_needed = math.ceil(n_validators / VALS_PER_JSON)
 print("For %d validators and %d per json, we need %d jsons (%d total entries)" %
       (n_validators, VALS_PER_JSON, n_jsons_needed, total_entries))
 
-# Each validator is present in multiple epochs, so entries per json depend on the number of validators and number of epochs
-entries_per_json = VALS_PER_JSON*epochs
-
+# Each json gets all the entries of VALS_PER_JSON validators
 i = 0
 if not os.path.exists('./data'):
     os.mkdir("./data")
-for cur in range(0, total_entries, entries_per_json):
+for cur in range(0, n_validators, VALS_PER_JSON):
+    page = validators[cur:cur+VALS_PER_JSON]
     json_file = open("data/data%d.json" % (i), "w")
-    print("Writing entries %d to %d" % (cur, cur+entries_per_json))
+    print("Writing validators #%d to #%d" % (page[0], page[-1]))
     # Print something that javascript will understand
-    json_str = "var data = %s\n" % (get_validators(db, cur, cur+entries_per_json))
+    json_str = "var data = %s\n" % (get_validators(db, page[0], page[-1]))
     json_file.write(json_str)
     json_file.close()
     i+=1